@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/kjk/cheatsheets/pkg/server"
+)
+
+// ArchiveFormat selects the container format used by
+// WriteServerFilesToArchive.
+type ArchiveFormat string
+
+const (
+	ArchiveFormatZip    ArchiveFormat = "zip"
+	ArchiveFormatTarGz  ArchiveFormat = "tar.gz"
+	ArchiveFormatTarZst ArchiveFormat = "tar.zst"
+)
+
+// archiveDeterministicTime is used as the mtime for every entry so archives
+// are reproducible byte-for-byte across runs regardless of wall-clock time.
+var archiveDeterministicTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveWriter is the minimal interface each supported container format
+// implements, so WriteServerFilesToArchive doesn't need to know the
+// specifics of zip vs. tar.
+type archiveWriter interface {
+	// CreateEntry returns a writer for a new entry of the given name and
+	// size. The caller must fully write size bytes and then may call
+	// CreateEntry again; it must not retain the returned writer afterwards.
+	CreateEntry(name string, size int64) (io.WriteCloser, error)
+	Close() error
+}
+
+// nopCloser adapts an io.Writer that doesn't need per-entry closing (zip
+// entries are flushed by the next Create call / the zip.Writer.Close call).
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func newZipArchiveWriter(w io.Writer) *zipArchiveWriter {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, flate.BestCompression)
+	})
+	return &zipArchiveWriter{zw: zw}
+}
+
+func (a *zipArchiveWriter) CreateEntry(name string, size int64) (io.WriteCloser, error) {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: archiveDeterministicTime,
+	}
+	fw, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{fw}, nil
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// tarArchiveWriter wraps archive/tar; entries must be written with
+// CreateEntry+full write before the next CreateEntry, same as tar's own
+// WriteHeader/Write contract.
+type tarArchiveWriter struct {
+	tw     *tar.Writer
+	closer io.Closer // the underlying gzip/zstd stream, closed after tw
+}
+
+func (a *tarArchiveWriter) CreateEntry(name string, size int64) (io.WriteCloser, error) {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: archiveDeterministicTime,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return nopCloser{a.tw}, nil
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+func newTarGzArchiveWriter(w io.Writer, level int) *tarArchiveWriter {
+	gw, _ := gzip.NewWriterLevel(w, level)
+	return &tarArchiveWriter{tw: tar.NewWriter(gw), closer: gw}
+}
+
+func newTarZstArchiveWriter(w io.Writer, level zstd.EncoderLevel) (*tarArchiveWriter, error) {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveWriter{tw: tar.NewWriter(zw), closer: zw}, nil
+}
+
+// ArchiveOptions configures compression level for the tar.gz/tar.zst
+// formats. Zero value uses sensible defaults.
+type ArchiveOptions struct {
+	// GzipLevel is passed to compress/gzip; 0 means gzip.DefaultCompression.
+	GzipLevel int
+	// ZstdLevel is passed to the streaming zstd encoder; 0 means
+	// zstd.SpeedDefault.
+	ZstdLevel zstd.EncoderLevel
+}
+
+// WriteServerFilesToArchive writes every handler's content to w as a single
+// archive in the given format (zip, tar.gz, or tar.zst). Entries use a
+// fixed mtime (archiveDeterministicTime) so archives are reproducible
+// byte-for-byte across runs of the same content.
+func WriteServerFilesToArchive(w io.Writer, format ArchiveFormat, handlers []server.Handler, opts ArchiveOptions) error {
+	var aw archiveWriter
+	var err error
+	switch format {
+	case "", ArchiveFormatZip:
+		aw = newZipArchiveWriter(w)
+	case ArchiveFormatTarGz:
+		level := opts.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		aw = newTarGzArchiveWriter(w, level)
+	case ArchiveFormatTarZst:
+		level := opts.ZstdLevel
+		if level == 0 {
+			level = zstd.SpeedDefault
+		}
+		aw, err = newTarZstArchiveWriter(w, level)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("WriteServerFilesToArchive: unknown archive format %q", format)
+	}
+
+	nFiles := 0
+	var writeErr error
+	writeFile := func(uri string, d []byte) {
+		if writeErr != nil {
+			return
+		}
+		name := strings.TrimPrefix(uri, "/")
+		var fw io.WriteCloser
+		fw, writeErr = aw.CreateEntry(name, int64(len(d)))
+		if writeErr != nil {
+			return
+		}
+		if _, writeErr = fw.Write(d); writeErr != nil {
+			return
+		}
+		writeErr = fw.Close()
+		if writeErr != nil {
+			return
+		}
+		sizeStr := formatSize(int64(len(d)))
+		if nFiles%128 == 0 {
+			logf(ctx(), "WriteServerFilesToArchive: %d file '%s' of size %s\n", nFiles+1, name, sizeStr)
+		}
+		nFiles++
+	}
+	server.IterContent(handlers, writeFile)
+	if writeErr != nil {
+		return writeErr
+	}
+	return aw.Close()
+}
+
+// archiveFormatFromFlag maps the -archive-format flag value to an
+// ArchiveFormat, defaulting to zip for an empty/unrecognized value.
+func archiveFormatFromFlag(s string) ArchiveFormat {
+	switch ArchiveFormat(s) {
+	case ArchiveFormatTarGz, ArchiveFormatTarZst:
+		return ArchiveFormat(s)
+	default:
+		return ArchiveFormatZip
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/kjk/notionapi"
@@ -31,6 +32,12 @@ type Book struct {
 	DirCache       string // full path of sub-directory "cache"
 	NotionCacheDir string
 
+	// MarkdownDir, if set, is a directory of *.md chapters (see
+	// loadMarkdownPages) served alongside (or instead of) this book's
+	// Notion-backed chapters. Most books leave this empty.
+	MarkdownDir   string
+	markdownPages []BookPage
+
 	// generated toc javascript data
 	tocData []byte
 	// url of combined tocData and app.js
@@ -43,15 +50,35 @@ type Book struct {
 	client *notionapi.CachingClient
 	// cache related
 	cache *Cache
+	// notionCache / gistCache / imagesCache back the NotionCacheDir-based
+	// logic above (and downloadBook's image fetches) with the configurable
+	// filecache buckets described in caches.toml
+	notionCache *FileCacheBucket
+	gistCache   *FileCacheBucket
+	imagesCache *FileCacheBucket
 
 	muSitemapURLS sync.Mutex
-	sitemapURLS   map[string]struct{}
+	sitemapURLS   map[string]sitemapEntry
+
+	// muImagesManifest / imagesManifest record the responsive width and
+	// WebP/AVIF siblings optimizeBookPageImages generates per image, saved
+	// to images.json (see optimize_images.go).
+	muImagesManifest sync.Mutex
+	imagesManifest   imagesManifest
 }
 
 func (b *Book) cachePath() string {
 	return filepath.Join(b.DirCache, "cache.txt")
 }
 
+// bookPageDestPath mirrors *Page's destFilePath() for a BookPage (e.g. a
+// MarkdownPage): uri is its ensured-".html" URL, already rooted at
+// b.URL().
+func (b *Book) bookPageDestPath(uri string) string {
+	rel := strings.TrimPrefix(uri, b.URL())
+	return filepath.Join(b.DirOnDisk, rel)
+}
+
 // this is where html etc. files for a book end up
 func (b *Book) destDir() string {
 	return b.DirOnDisk
@@ -75,6 +102,28 @@ func (b *Book) CanonnicalURL() string {
 	return urlJoin(siteBaseURL, b.URL())
 }
 
+// FeedAtomURL returns the book's Atom feed URL, relative to the site root.
+func (b *Book) FeedAtomURL() string {
+	return b.URL() + "feed.atom"
+}
+
+// FeedRSSURL returns the book's RSS feed URL, relative to the site root.
+func (b *Book) FeedRSSURL() string {
+	return b.URL() + "feed.rss"
+}
+
+// FeedAtomFullURL returns the book's Atom feed URL including host. This is
+// the value PageCommon's <link rel="alternate" type="application/atom+xml">
+// should point to on the book's HTML pages.
+func (b *Book) FeedAtomFullURL() string {
+	return urlJoin(siteBaseURL, b.FeedAtomURL())
+}
+
+// FeedRSSFullURL returns the book's RSS feed URL including host.
+func (b *Book) FeedRSSFullURL() string {
+	return urlJoin(siteBaseURL, b.FeedRSSURL())
+}
+
 // ShareOnTwitterText returns text for sharing on twitter
 func (b *Book) ShareOnTwitterText() string {
 	return fmt.Sprintf(`"%s" - a free programming book`, b.TitleLong)
@@ -185,10 +234,24 @@ func calcPageHeadings(page *Page) {
 func initBook(book *Book) {
 	book.DirOnDisk = filepath.Join(gDestDir, "www", "essential", book.DirShort)
 	book.DirCache = filepath.Join("books", book.DirShort, "cache")
-	book.NotionCacheDir = filepath.Join(book.DirCache, "notion")
+	defaultNotionDir := filepath.Join(book.DirCache, "notion")
+	book.notionCache = gFileCaches.Bucket("notion", book.DirShort, defaultNotionDir)
+	book.NotionCacheDir = book.notionCache.Dir
+	book.gistCache = gFileCaches.Bucket("gists", book.DirShort, filepath.Join(book.DirCache, "gists"))
+	book.imagesCache = gFileCaches.Bucket("images", book.DirShort, filepath.Join(book.DirCache, "img"))
 	book.idToPage = map[string]*Page{}
-	book.sitemapURLS = map[string]struct{}{}
+	book.sitemapURLS = map[string]sitemapEntry{}
+	book.imagesManifest = loadImagesManifest(book)
 	book.cache = loadCache(book)
+
+	if book.MarkdownDir != "" {
+		pages, err := loadMarkdownPages(book, book.MarkdownDir)
+		if err != nil {
+			logf("initBook: failed to load markdown pages from '%s': %s\n", book.MarkdownDir, err)
+		} else {
+			book.markdownPages = pages
+		}
+	}
 }
 
 func downloadBook(book *Book) {
@@ -202,7 +265,8 @@ func downloadBook(book *Book) {
 	u.CreateDirMust(cacheDir)
 	d, err := notionapi.NewCachingClient(cacheDir, c)
 	must(err)
-	d.CacheDirFiles = filepath.Join(cacheDir, "img")
+	u.CreateDirMust(book.imagesCache.Dir)
+	d.CacheDirFiles = book.imagesCache.Dir
 	if flgDisableNotionCache {
 		d.Policy = notionapi.PolicyDownloadAlways
 	} else if flgNoDownload {
@@ -225,12 +289,16 @@ func downloadBook(book *Book) {
 			evalCodeSnippetsForPage(p)
 		}
 		downloadImages(d, book, p)
+		optimizeBookPageImages(book, p)
 		calcPageHeadings(p)
 		return nil
 	}
 
 	pages, err := d.DownloadPagesRecursively(startPageID, afterPageDownload)
 	must(err)
+	if err := saveImagesManifest(book); err != nil {
+		logf("downloadBook: failed to save images manifest: %s\n", err)
+	}
 	nPages := len(pages)
 	logf("Got %d pages for %s, downloaded: %d, from cache: %d\n", nPages, book.Title, d.DownloadedCount, d.FromCacheCount)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// BookPage is the common interface a book's content conforms to, whether
+// it came from Notion or from a local markdown file. genBookHandler
+// serves a book's MarkdownDir chapters (see Book.markdownPages) purely
+// through this interface, so non-Notion content doesn't need a *Page at
+// all.
+//
+// Scope note: the concrete *Page type (NotionID, BodyHTML, Pages, Parent,
+// images, etc.) is defined and accessed by field throughout this package
+// and stays on its own code path in genBookHandler (it needs the image
+// cache and sitemap plumbing that's keyed on *Page specifically).
+// notionBookPage adapts it to BookPage for callers that only need the
+// interface (e.g. walking a book's chapters uniformly regardless of
+// source).
+type BookPage interface {
+	Title() string
+	ID() string
+	URL() string
+	Headings() []*HeadingInfo
+	RenderHTML(w io.Writer) error
+	Images() []string
+	LastEdited() time.Time
+	Children() []BookPage
+}
+
+// notionBookPage adapts the existing Notion-backed *Page to BookPage.
+type notionBookPage struct {
+	page *Page
+	book *Book
+}
+
+func newNotionBookPage(book *Book, page *Page) BookPage {
+	return &notionBookPage{page: page, book: book}
+}
+
+func (p *notionBookPage) Title() string { return p.page.Title }
+func (p *notionBookPage) ID() string    { return p.page.NotionID }
+func (p *notionBookPage) URL() string   { return p.page.URL() }
+
+func (p *notionBookPage) Headings() []*HeadingInfo { return p.page.Headings }
+
+func (p *notionBookPage) RenderHTML(w io.Writer) error {
+	html := notionToHTML(p.page, p.book)
+	_, err := w.Write(html)
+	return err
+}
+
+func (p *notionBookPage) Images() []string { return p.page.images }
+
+func (p *notionBookPage) LastEdited() time.Time { return pageLastEditedTime(p.page) }
+
+func (p *notionBookPage) Children() []BookPage {
+	children := make([]BookPage, 0, len(p.page.Pages))
+	for _, child := range p.page.Pages {
+		children = append(children, newNotionBookPage(p.book, child))
+	}
+	return children
+}
+
+var _ BookPage = (*notionBookPage)(nil)
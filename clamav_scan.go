@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/kjk/programming-books.io/pkg/clamav"
+)
+
+var (
+	flgClamAVAddr string
+
+	// gClamAV is nil unless -clamav-addr (or CLAMAV_ADDR) was provided, in
+	// which case downloaded gists and images are scanned before being
+	// written into the cache or destination dir.
+	gClamAV *clamav.Client
+
+	// nInfectedAssets counts rejected assets across the whole run, so main
+	// can return a non-zero exit code if any book had infected assets.
+	nInfectedAssets int32
+)
+
+func initClamAV(addr string) {
+	if addr == "" {
+		addr = os.Getenv("CLAMAV_ADDR")
+	}
+	if addr == "" {
+		return
+	}
+	gClamAV = clamav.NewClient(addr, 10*time.Second)
+	if err := gClamAV.Ping(); err != nil {
+		logf("initClamAV: clamd at '%s' not reachable: %s\n", addr, err)
+	}
+}
+
+// scanForClamAV scans data (sourceDesc is the gist ID / image URL / path
+// logged alongside a rejection) and returns an error if it's infected or
+// clamd couldn't be reached. The cache entry / destination file must not be
+// created when this returns a non-nil error.
+func scanForClamAV(data []byte, sourceDesc string) error {
+	if gClamAV == nil {
+		return nil
+	}
+	res, err := gClamAV.InStream(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("clamav: failed to scan '%s': %w", sourceDesc, err)
+	}
+	if res.Infected {
+		atomic.AddInt32(&nInfectedAssets, 1)
+		logf("clamav: REJECTED '%s': infected with '%s'\n", sourceDesc, res.Signature)
+		return fmt.Errorf("clamav: '%s' is infected with '%s'", sourceDesc, res.Signature)
+	}
+	return nil
+}
+
+// scanFileForClamAV is scanForClamAV for a file already on disk (used by
+// copyImages, which copies from a local source tree rather than a
+// downloaded blob).
+func scanFileForClamAV(path string) error {
+	if gClamAV == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return scanForClamAV(data, path)
+}
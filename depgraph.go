@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// identity fingerprints one thing a rendered URL can depend on: a Notion
+// page, a template, a cover image, or the book's TOC. Kind+Key identifies
+// *what* it is; Hash is a snapshot of its content at the time a URL
+// consumed it, so a later mismatch means "this changed since we last
+// rendered".
+type identity struct {
+	Kind string // "page", "template", "cover", "toc"
+	Key  string
+	Hash string
+}
+
+func (id identity) source() string { return id.Kind + ":" + id.Key }
+
+// depGraph records, per rendered URL, the set of identities it consumed
+// while rendering. On a change notification it's used to compute the dirty
+// URL set by walking the reverse edges (source -> dependent URLs).
+type depGraph struct {
+	mu sync.Mutex
+	// depsFor[url] is the identities (with the hash at render time) that url
+	// consumed the last time it was rendered.
+	depsFor map[string][]identity
+	// dependents[source] is the set of URLs that currently depend on source
+	// (a Kind+Key pair, regardless of hash).
+	dependents map[string]map[string]bool
+	// generation[url] bumps every time url's deps are (re)recorded, so a
+	// memcache entry can be tagged with the generation it was rendered at.
+	generation map[string]int64
+	nextGen    int64
+}
+
+func newDepGraph() *depGraph {
+	return &depGraph{
+		depsFor:    map[string][]identity{},
+		dependents: map[string]map[string]bool{},
+		generation: map[string]int64{},
+	}
+}
+
+// recordDeps replaces the recorded dependencies for url. Call this every
+// time url is (re)rendered.
+func (g *depGraph) recordDeps(url string, deps []identity) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, id := range g.depsFor[url] {
+		if set := g.dependents[id.source()]; set != nil {
+			delete(set, url)
+		}
+	}
+	g.depsFor[url] = deps
+	for _, id := range deps {
+		src := id.source()
+		if g.dependents[src] == nil {
+			g.dependents[src] = map[string]bool{}
+		}
+		g.dependents[src][url] = true
+	}
+	g.nextGen++
+	g.generation[url] = g.nextGen
+}
+
+// currentGeneration returns the generation number assigned the last time
+// url's deps were recorded, or 0 if it's never been rendered.
+func (g *depGraph) currentGeneration(url string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generation[url]
+}
+
+// dirtyURLs returns every URL that depends on kind:key and whose recorded
+// hash no longer matches newHash, i.e. the set that must be re-rendered.
+func (g *depGraph) dirtyURLs(kind, key, newHash string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	src := kind + ":" + key
+	var dirty []string
+	for url := range g.dependents[src] {
+		for _, id := range g.depsFor[url] {
+			if id.source() == src && id.Hash != newHash {
+				dirty = append(dirty, url)
+				break
+			}
+		}
+	}
+	sort.Strings(dirty)
+	return dirty
+}
+
+// depsOf returns the identities url consumed the last time it was
+// rendered, for the /_debug/deps endpoint.
+func (g *depGraph) depsOf(url string) []identity {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]identity(nil), g.depsFor[url]...)
+}
+
+// dependentsOf returns every URL currently depending on kind:key.
+func (g *depGraph) dependentsOf(kind, key string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	src := kind + ":" + key
+	var urls []string
+	for url := range g.dependents[src] {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+var bookDepGraphs = struct {
+	mu sync.Mutex
+	m  map[string]*depGraph
+}{m: map[string]*depGraph{}}
+
+// getOrCreateDepGraph returns the shared dep graph for book, so the preview
+// server's page handler and the /_debug/deps endpoint see the same state.
+func getOrCreateDepGraph(book *Book) *depGraph {
+	bookDepGraphs.mu.Lock()
+	defer bookDepGraphs.mu.Unlock()
+	g := bookDepGraphs.m[book.DirShort]
+	if g == nil {
+		g = newDepGraph()
+		bookDepGraphs.m[book.DirShort] = g
+	}
+	return g
+}
+
+// depsStillFresh reports whether every identity url last rendered with
+// still matches its current hash, i.e. whether a cached render of url can
+// be served as-is.
+func depsStillFresh(g *depGraph, url string, current ...identity) bool {
+	recorded := g.depsOf(url)
+	if len(recorded) != len(current) {
+		return false
+	}
+	hashOf := map[string]string{}
+	for _, id := range recorded {
+		hashOf[id.source()] = id.Hash
+	}
+	for _, id := range current {
+		if hashOf[id.source()] != id.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+func hashString(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileFingerprint hashes a file's mtime+size, which is cheap and good
+// enough to detect "this template/cover changed on disk" without reading
+// and hashing the whole file on every render.
+func fileFingerprint(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return hashString(fmt.Sprintf("%s:%d", fi.ModTime().UnixNano(), fi.Size()))
+}
+
+func templateIdentity(name string) identity {
+	path := filepath.Join("fe", "tmpl", name)
+	return identity{Kind: "template", Key: name, Hash: fileFingerprint(path)}
+}
+
+func coverIdentity(book *Book) identity {
+	path := filepath.Join("covers", book.CoverImageName)
+	return identity{Kind: "cover", Key: book.CoverImageName, Hash: fileFingerprint(path)}
+}
+
+func tocIdentity(book *Book) identity {
+	return identity{Kind: "toc", Key: book.DirShort, Hash: hashString(string(book.tocData))}
+}
+
+func pageIdentity(page *Page) identity {
+	hash := ""
+	if page.NotionPage != nil {
+		if root := page.NotionPage.Root(); root != nil {
+			hash = hashString(fmt.Sprintf("%d", root.LastEditedTime))
+		}
+	}
+	return identity{Kind: "page", Key: page.NotionID, Hash: hash}
+}
+
+// serveDebugDeps renders the /_debug/deps endpoint: given ?url=, list what
+// it depends on; with no query, list every URL that currently has recorded
+// dependencies (so authors can spot-check coverage).
+func serveDebugDeps(g *depGraph) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		uri := r.URL.Query().Get("url")
+		if uri == "" {
+			g.mu.Lock()
+			var urls []string
+			for u := range g.depsFor {
+				urls = append(urls, u)
+			}
+			g.mu.Unlock()
+			sort.Strings(urls)
+			fmt.Fprintf(w, "%d urls with recorded dependencies. Pass ?url=<uri> for details.\n", len(urls))
+			for _, u := range urls {
+				fmt.Fprintf(w, "  %s\n", u)
+			}
+			return
+		}
+		deps := g.depsOf(uri)
+		fmt.Fprintf(w, "dependencies of %s (%d):\n", uri, len(deps))
+		for _, id := range deps {
+			fmt.Fprintf(w, "  %s:%s @%s\n", id.Kind, id.Key, id.Hash)
+		}
+		fmt.Fprintf(w, "\ndependents of %s as a source (other URLs depending on this exact uri as a page id):\n", uri)
+		for _, dep := range g.dependentsOf("page", uri) {
+			fmt.Fprintf(w, "  %s\n", dep)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/xml"
+	"sort"
+	"time"
+
+	"github.com/kjk/notionapi"
+)
+
+// feedMaxEntries caps how many of a book's (or the whole site's) most
+// recently edited pages go into its Atom/RSS feeds.
+const feedMaxEntries = 20
+
+// feedEntry is one page, reduced to what an Atom/RSS entry needs.
+type feedEntry struct {
+	Title   string
+	URL     string
+	GUID    string // notion page NoDashID: stable across edits, unlike the URL
+	Summary string
+	Updated time.Time
+}
+
+// pageSummary returns the plain text of page's first text block, used as
+// the feed entry summary/description.
+func pageSummary(page *Page) string {
+	if page.NotionPage == nil {
+		return ""
+	}
+	var summary string
+	cb := func(block *notionapi.Block) {
+		if summary != "" || block.Type != notionapi.BlockText {
+			return
+		}
+		summary = getInlinesPlain(block.InlineContent)
+	}
+	notionapi.ForEachBlock([]*notionapi.Block{page.NotionPage.Root()}, cb)
+	return summary
+}
+
+func pageFeedEntry(page *Page) feedEntry {
+	return feedEntry{
+		Title:   page.Title,
+		URL:     page.CanonnicalURL(),
+		GUID:    page.NotionID,
+		Summary: pageSummary(page),
+		Updated: pageLastEditedTime(page),
+	}
+}
+
+// collectFeedEntries turns pages into feed entries sorted by most recently
+// edited first, capped at n.
+func collectFeedEntries(pages []*Page, n int) []feedEntry {
+	var entries []feedEntry
+	for _, page := range pages {
+		if page == nil || page.NotionPage == nil {
+			continue
+		}
+		entries = append(entries, pageFeedEntry(page))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Updated.After(entries[j].Updated) })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// atomFeed / atomEntry mirror RFC 4287 closely enough for a read-only feed.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary"`
+}
+
+const atomNS = "http://www.w3.org/2005/Atom"
+
+// renderAtomFeed renders entries as an Atom feed. feedURL is this feed's
+// own absolute URL (used as both <id> and the self link); siteURL is the
+// alternate (human-readable) page the feed is for.
+func renderAtomFeed(title, feedURL, siteURL string, entries []feedEntry) []byte {
+	f := atomFeed{
+		Xmlns: atomNS,
+		Title: title,
+		ID:    feedURL,
+		Links: []atomLink{
+			{Rel: "self", Href: feedURL, Type: "application/atom+xml"},
+			{Rel: "alternate", Href: siteURL, Type: "text/html"},
+		},
+	}
+	updated := time.Now()
+	for _, e := range entries {
+		if !e.Updated.IsZero() {
+			updated = e.Updated
+		}
+		f.Entries = append(f.Entries, atomEntry{
+			Title:   e.Title,
+			ID:      "urn:notion:" + e.GUID,
+			Link:    atomLink{Rel: "alternate", Href: e.URL, Type: "text/html"},
+			Updated: e.Updated.Format(time.RFC3339),
+			Summary: e.Summary,
+		})
+	}
+	f.Updated = updated.Format(time.RFC3339)
+	d, err := xml.MarshalIndent(f, "", "  ")
+	must(err)
+	return append([]byte(xml.Header), d...)
+}
+
+// rssFeed / rssItem mirror the RSS 2.0 spec closely enough for a read-only
+// feed: https://www.rssboard.org/rss-specification
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+}
+
+func renderRSSFeed(title, link, description string, entries []feedEntry) []byte {
+	ch := rssChannel{Title: title, Link: link, Description: description}
+	for _, e := range entries {
+		ch.Items = append(ch.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        "urn:notion:" + e.GUID,
+			Description: e.Summary,
+			PubDate:     e.Updated.Format(time.RFC1123Z),
+		})
+	}
+	f := rssFeed{Version: "2.0", Channel: ch}
+	d, err := xml.MarshalIndent(f, "", "  ")
+	must(err)
+	return append([]byte(xml.Header), d...)
+}
+
+// genBookFeedHandler builds book's feed.atom / feed.rss from its N most
+// recently edited pages. Call once book's pages are populated (after
+// buildBookPages), same as genBookTOCSearchHandlerMust.
+func genBookFeedHandler(book *Book) Handler {
+	entries := collectFeedEntries(book.GetAllPages(), feedMaxEntries)
+	title := book.TitleLong + " updates"
+	atomData := renderAtomFeed(title, book.FeedAtomFullURL(), book.CanonnicalURL(), entries)
+	rssData := renderRSSFeed(title, book.CanonnicalURL(), string(book.Summary()), entries)
+	h := NewContentHandler(book.FeedAtomURL(), atomData)
+	h.Add(book.FeedRSSURL(), rssData)
+	return h
+}
+
+// genSiteFeedHandler aggregates the most recently edited pages across every
+// book into a single site-level /feed.atom. Call after all books finish
+// building, same as genSitemapHandler.
+func genSiteFeedHandler(books []*Book) Handler {
+	var entries []feedEntry
+	for _, b := range books {
+		entries = append(entries, collectFeedEntries(b.GetAllPages(), feedMaxEntries)...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Updated.After(entries[j].Updated) })
+	if len(entries) > feedMaxEntries {
+		entries = entries[:feedMaxEntries]
+	}
+	feedURL := urlJoin(siteBaseURL, "feed.atom")
+	data := renderAtomFeed("programming-books.io updates", feedURL, siteBaseURL, entries)
+	return NewContentHandler("/feed.atom", data)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kjk/u"
+)
+
+// FileCacheBucket is a single named, directory-backed cache with its own
+// eviction policy (e.g. "notion", "gists", "images"). Entries are written
+// atomically (write-to-temp + rename) and reads/writes for a given key are
+// serialized so parallel book generation can't corrupt an entry.
+type FileCacheBucket struct {
+	Name   string
+	Dir    string
+	MaxAge time.Duration
+
+	mu       sync.Mutex // guards keyLocks
+	keyLocks map[string]*sync.Mutex
+}
+
+func newFileCacheBucket(name, dir string, maxAge time.Duration) *FileCacheBucket {
+	return &FileCacheBucket{
+		Name:     name,
+		Dir:      dir,
+		MaxAge:   maxAge,
+		keyLocks: map[string]*sync.Mutex{},
+	}
+}
+
+// lockFor returns the per-key lock, creating it if necessary, and returns
+// an unlock function the caller must defer.
+func (b *FileCacheBucket) lockFor(key string) func() {
+	b.mu.Lock()
+	kl, ok := b.keyLocks[key]
+	if !ok {
+		kl = &sync.Mutex{}
+		b.keyLocks[key] = kl
+	}
+	b.mu.Unlock()
+	kl.Lock()
+	return kl.Unlock
+}
+
+// pathForKey hashes key into a flat, filesystem-safe file name under Dir.
+func (b *FileCacheBucket) pathForKey(key string) string {
+	h := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(b.Dir, name)
+}
+
+// Get reads a cached entry. ok is false if the entry is missing or has
+// expired according to MaxAge (an expired file is left on disk; Put will
+// overwrite it).
+func (b *FileCacheBucket) Get(key string) (data []byte, ok bool) {
+	unlock := b.lockFor(key)
+	defer unlock()
+
+	path := b.pathForKey(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if b.MaxAge > 0 && time.Since(fi.ModTime()) > b.MaxAge {
+		return nil, false
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return d, true
+}
+
+// Put writes data for key atomically: it writes to a temp file in Dir and
+// renames it into place, so a crash or concurrent reader never observes a
+// partial entry.
+func (b *FileCacheBucket) Put(key string, data []byte) error {
+	unlock := b.lockFor(key)
+	defer unlock()
+
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+	path := b.pathForKey(key)
+	tmp, err := ioutil.TempFile(b.Dir, ".tmp-filecache-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// filecacheBucketConfig is the on-disk (TOML) shape of a single bucket entry.
+type filecacheBucketConfig struct {
+	Dir    string `toml:"dir"`
+	MaxAge string `toml:"max_age"`
+}
+
+// filecacheConfig is the on-disk (TOML) shape of caches.toml.
+type filecacheConfig struct {
+	Bucket map[string]filecacheBucketConfig `toml:"bucket"`
+}
+
+// bucketTemplate is a bucket's config as read from caches.toml: dir may
+// still contain an unresolved `:book` placeholder, since the book isn't
+// known until a per-book Bucket() call resolves it.
+type bucketTemplate struct {
+	dir    string
+	maxAge time.Duration
+}
+
+// FileCacheSet is a collection of named FileCacheBuckets loaded from a
+// caches.toml config file. Buckets are created lazily, per (name, book)
+// pair, so books configured with the same `dir = ":bookDir/:book/..."`
+// template each get their own directory instead of colliding on one.
+type FileCacheSet struct {
+	templates map[string]bucketTemplate
+	buckets   map[string]*FileCacheBucket
+	mu        sync.Mutex
+}
+
+// resolveCachePlaceholders replaces `:cacheDir`, `:bookDir` and any other
+// vars entry in s with its corresponding value. A literal `:book` is left
+// untouched if vars doesn't define it: that placeholder is resolved later,
+// per book, by Bucket.
+func resolveCachePlaceholders(s string, vars map[string]string) string {
+	for name, val := range vars {
+		s = strings.ReplaceAll(s, ":"+name, val)
+	}
+	return s
+}
+
+// loadFileCacheSet reads caches.toml at path and resolves each bucket's dir
+// against vars (e.g. {"cacheDir": "...", "bookDir": "..."}); a `:book`
+// placeholder, if present, is resolved later by Bucket since no book is
+// known yet. A missing config file is not an error: callers get an empty
+// set and fall back to whatever default dirs they already use.
+func loadFileCacheSet(path string, vars map[string]string) (*FileCacheSet, error) {
+	set := &FileCacheSet{
+		templates: map[string]bucketTemplate{},
+		buckets:   map[string]*FileCacheBucket{},
+	}
+	if !u.PathExists(path) {
+		return set, nil
+	}
+	var cfg filecacheConfig
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, fmt.Errorf("loadFileCacheSet: failed to parse '%s': %w", path, err)
+	}
+	for name, bc := range cfg.Bucket {
+		dir := resolveCachePlaceholders(bc.Dir, vars)
+		maxAge, err := time.ParseDuration(bc.MaxAge)
+		if err != nil && bc.MaxAge != "" {
+			return nil, fmt.Errorf("loadFileCacheSet: bucket '%s' has invalid max_age '%s': %w", name, bc.MaxAge, err)
+		}
+		set.templates[name] = bucketTemplate{dir: dir, maxAge: maxAge}
+	}
+	return set, nil
+}
+
+// Bucket returns the cache bucket for (name, book), creating it on first
+// use: if caches.toml configured name, its dir template has `:book`
+// resolved to book (so each book gets its own sub-directory); otherwise
+// defaultDir (which callers already make book-specific) is used as-is.
+func (s *FileCacheSet) Bucket(name, book, defaultDir string) *FileCacheBucket {
+	key := name + "|" + book
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buckets[key]; ok {
+		return b
+	}
+	var b *FileCacheBucket
+	if tmpl, ok := s.templates[name]; ok {
+		dir := strings.ReplaceAll(tmpl.dir, ":book", book)
+		b = newFileCacheBucket(name, dir, tmpl.maxAge)
+	} else {
+		b = newFileCacheBucket(name, defaultDir, 0)
+	}
+	s.buckets[key] = b
+	return b
+}
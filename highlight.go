@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// flgHighlightStyle is the chroma style (theme) used to render code
+// blocks server-side; see -highlight-style.
+var flgHighlightStyle = "github"
+
+// highlightCacheKey namespaces entries in the shared gPageCache so
+// highlighted snippets don't collide with rendered-page entries.
+func highlightCacheKey(lang, style, source string) string {
+	return "highlight|" + style + "|" + lang + "|" + hashString(source)
+}
+
+// highlightCode tokenizes source server-side with chroma, using lang if
+// chroma recognizes it or lexer auto-detection otherwise, and returns a
+// '<pre class="chroma">...</pre>' fragment with class-based tokens (paired
+// with the chroma.css written by writeChromaCSS). Results are cached in
+// gPageCache, keyed by (language, style, content-hash), since highlighting
+// dominates rebuild time for code-heavy books.
+func highlightCode(lang, source string) (template.HTML, error) {
+	initPageCache()
+	key := highlightCacheKey(lang, flgHighlightStyle, source)
+	if cached, ok := gPageCache.Get(key); ok {
+		return template.HTML(cached.Value), nil
+	}
+
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		lexer = lexers.Analyse(source)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	style := styles.Get(flgHighlightStyle)
+	if style == nil {
+		style = styles.Fallback
+	}
+
+	iterator, err := lexer.Tokenise(nil, source)
+	if err != nil {
+		return "", fmt.Errorf("highlightCode: tokenise failed for lang '%s': %w", lang, err)
+	}
+
+	formatter := chromahtml.New(chromahtml.WithClasses(true), chromahtml.TabWidth(4))
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		return "", fmt.Errorf("highlightCode: format failed for lang '%s': %w", lang, err)
+	}
+
+	html := buf.Bytes()
+	gPageCache.Put(key, html, 0)
+	return template.HTML(html), nil
+}
+
+// codeTemplateFunc is the "code" template helper: it lets non-Notion
+// sources (MarkdownPage fenced code blocks) request the same server-side
+// highlighting pipeline as Notion code blocks. Register it in the
+// template FuncMap alongside the other helpers passed to execTemplate.
+// Errors fall back to an unhighlighted <pre> rather than failing the page.
+func codeTemplateFunc(lang, source string) template.HTML {
+	out, err := highlightCode(lang, source)
+	if err != nil {
+		logf("codeTemplateFunc: %s\n", err)
+		return template.HTML("<pre>" + template.HTMLEscapeString(source) + "</pre>")
+	}
+	return out
+}
+
+// writeChromaCSS writes the CSS for flgHighlightStyle's chroma tokens to
+// <dir>/chroma.css, so pages generated with class-based highlighting (see
+// highlightCode) render correctly. Called during the frontend build, same
+// as the rest of www/gen's generated assets.
+func writeChromaCSS(dir, styleName string) error {
+	style := styles.Get(styleName)
+	if style == nil {
+		style = styles.Fallback
+	}
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	var buf bytes.Buffer
+	if err := formatter.WriteCSS(&buf, style); err != nil {
+		return fmt.Errorf("writeChromaCSS: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "chroma.css")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	logf("writeChromaCSS: wrote '%s' for style '%s'\n", path, styleName)
+	return nil
+}
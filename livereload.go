@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadBroker fans out "reload" events to every connected browser over
+// Server-Sent Events at /__reload, so previewWebsite can push a refresh
+// as soon as a regeneration finishes.
+type reloadBroker struct {
+	mu   sync.Mutex
+	subs map[chan string]bool
+}
+
+func newReloadBroker() *reloadBroker {
+	return &reloadBroker{subs: map[chan string]bool{}}
+}
+
+func (rb *reloadBroker) subscribe() chan string {
+	ch := make(chan string, 4)
+	rb.mu.Lock()
+	rb.subs[ch] = true
+	rb.mu.Unlock()
+	return ch
+}
+
+func (rb *reloadBroker) unsubscribe(ch chan string) {
+	rb.mu.Lock()
+	delete(rb.subs, ch)
+	rb.mu.Unlock()
+	close(ch)
+}
+
+// broadcast sends msg (typically a book's dir, or "" for "reload anything
+// you're showing") to every connected browser.
+func (rb *reloadBroker) broadcast(msg string) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for ch := range rb.subs {
+		select {
+		case ch <- msg:
+		default:
+			// slow subscriber; drop the event rather than blocking the watcher
+		}
+	}
+}
+
+func (rb *reloadBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := rb.subscribe()
+	defer rb.unsubscribe(ch)
+
+	ctxDone := r.Context().Done()
+	for {
+		select {
+		case msg := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		case <-ctxDone:
+			return
+		}
+	}
+}
+
+const reloadScriptTag = `<script>
+new EventSource("/__reload").onmessage = function() { location.reload(); };
+</script>`
+
+// reloadScriptInjectingWriter buffers a response and, if it looks like
+// HTML, injects reloadScriptTag right before </body> before flushing it to
+// the real ResponseWriter. Used only when isPreview() is true.
+type reloadScriptInjectingWriter struct {
+	http.ResponseWriter
+	buf         []byte
+	statusCode  int
+	wroteHeader bool
+}
+
+func newReloadScriptInjectingWriter(w http.ResponseWriter) *reloadScriptInjectingWriter {
+	return &reloadScriptInjectingWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (w *reloadScriptInjectingWriter) WriteHeader(code int) {
+	w.statusCode = code
+	w.wroteHeader = true
+	// defer the real WriteHeader call until flush(), once we know whether
+	// we're injecting (Content-Length would otherwise be wrong)
+}
+
+func (w *reloadScriptInjectingWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *reloadScriptInjectingWriter) flush() {
+	ct := w.Header().Get("Content-Type")
+	body := w.buf
+	if strings.Contains(ct, "text/html") {
+		body = injectReloadScript(body)
+	}
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	}
+	w.ResponseWriter.Write(body)
+}
+
+func injectReloadScript(htmlBody []byte) []byte {
+	const marker = "</body>"
+	idx := bytes.LastIndex(htmlBody, []byte(marker))
+	if idx < 0 {
+		return append(htmlBody, []byte(reloadScriptTag)...)
+	}
+	out := make([]byte, 0, len(htmlBody)+len(reloadScriptTag))
+	out = append(out, htmlBody[:idx]...)
+	out = append(out, []byte(reloadScriptTag)...)
+	out = append(out, htmlBody[idx:]...)
+	return out
+}
+
+// bookBuildErrors records the last regeneration error for a book, keyed by
+// DirShort, so previews can serve a build-error overlay in place of stale
+// or half-regenerated content instead of a raw 500.
+var (
+	muBookBuildErrors sync.Mutex
+	bookBuildErrors   = map[string]error{}
+)
+
+func setBookBuildError(book *Book, err error) {
+	muBookBuildErrors.Lock()
+	defer muBookBuildErrors.Unlock()
+	if err == nil {
+		delete(bookBuildErrors, book.DirShort)
+		return
+	}
+	bookBuildErrors[book.DirShort] = err
+}
+
+func getBookBuildError(book *Book) error {
+	muBookBuildErrors.Lock()
+	defer muBookBuildErrors.Unlock()
+	return bookBuildErrors[book.DirShort]
+}
+
+func buildErrorOverlayHTML(book *Book, err error) []byte {
+	s := fmt.Sprintf(`<!doctype html>
+<html><head><title>Build error: %s</title></head>
+<body style="font-family: monospace; background: #2b0000; color: #fff; padding: 2em;">
+<h1>Build error in "%s"</h1>
+<pre>%s</pre>
+<p>Fix the error and save again; this page will reload automatically.</p>
+%s
+</body></html>`, book.Title, book.Title, html.EscapeString(err.Error()), reloadScriptTag)
+	return []byte(s)
+}
+
+// watchAndRegenerate watches each book's Notion cache dir plus the shared
+// covers/ and fe/tmpl directories for changes, debounces bursts of fs
+// events into a single regeneration per book (200ms window), and
+// broadcasts a reload over rb once the (possibly failing) regeneration
+// finishes. Changes under covers/ or fe/tmpl regenerate every book, since
+// neither is specific to one.
+func watchAndRegenerate(books []*Book, rb *reloadBroker) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dirToBook := map[string]*Book{}
+	addWatch := func(dir string, book *Book) {
+		if dir == "" {
+			return
+		}
+		if err := watcher.Add(dir); err != nil {
+			logf(ctx(), "watchAndRegenerate: failed to watch '%s': %s\n", dir, err)
+			return
+		}
+		dirToBook[dir] = book
+	}
+	for _, book := range books {
+		addWatch(book.NotionCacheDir, book)
+	}
+	addWatch("covers", nil)                    // shared cover images directory; any book's cover could be the one that changed
+	addWatch(filepath.Join("fe", "tmpl"), nil) // shared templates affect every book
+
+	var mu sync.Mutex
+	pending := map[*Book]bool{}
+	pendingAll := false
+	var timer *time.Timer
+
+	flush := func() {
+		mu.Lock()
+		toRegen := pending
+		all := pendingAll
+		pending = map[*Book]bool{}
+		pendingAll = false
+		mu.Unlock()
+
+		targets := books
+		if !all {
+			targets = nil
+			for b := range toRegen {
+				targets = append(targets, b)
+			}
+		}
+		for _, book := range targets {
+			err := regenerateBookSafely(book)
+			setBookBuildError(book, err)
+		}
+		rb.broadcast("")
+	}
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				dir := filepath.Dir(ev.Name)
+				book := dirToBook[dir]
+				mu.Lock()
+				if book == nil {
+					pendingAll = true
+				} else {
+					pending[book] = true
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(200*time.Millisecond, flush)
+				mu.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logf(ctx(), "watchAndRegenerate: watcher error: %s\n", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+func regenerateBookSafely(book *Book) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	logf(ctx(), "watchAndRegenerate: regenerating '%s'\n", book.DirShort)
+	downloadBook(book)
+	genBook(book)
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/kjk/notionapi"
@@ -21,9 +22,18 @@ var (
 	notionAuthToken string
 
 	// when downloading pages from the server, count total number of
-	// downloaded and those from cache
-	nTotalDownloaded int
-	nTotalFromCache  int
+	// downloaded and those from cache. Incremented from eventObserver,
+	// which can fire concurrently across books in the -j>1 parallel path,
+	// so these are int32 and must only be touched via sync/atomic.
+	nTotalDownloaded int32
+	nTotalFromCache  int32
+
+	// total files and bytes written by WriteServerFilesToDir/
+	// WriteServerFilesToDirCAS, surfaced on multiBar's aggregate line.
+	// Incremented there, which can run concurrently with itself across
+	// books, so these are int64 and must only be touched via sync/atomic.
+	nTotalFilesWritten int64
+	nTotalBytesWritten int64
 )
 
 var (
@@ -39,10 +49,12 @@ func eventObserver(ev interface{}) {
 	case *notionapi.EventDidDownload:
 		nProcessed++
 		nDownloadedPages++
+		atomic.AddInt32(&nTotalDownloaded, 1)
 		logf("%03d '%s' : downloaded in %s\n", nProcessed, v.PageID, v.Duration)
 	case *notionapi.EventDidReadFromCache:
 		nProcessed++
 		nNotionPagesFromCache++
+		atomic.AddInt32(&nTotalFromCache, 1)
 		if nNotionPagesFromCache < 4 || nNotionPagesFromCache%16 == 0 {
 			logf("%03d '%s' : read from cache in %s\n", nProcessed, v.PageID, v.Duration)
 		}
@@ -64,13 +76,23 @@ func copyCoversMust(dir string) {
 	u.DirCopyRecurMust(dstDir, srcDir, shouldCopyImage)
 }
 
+// shouldCopyImageClamAV is passed to u.DirCopyRecurMust as the copy filter
+// so an image flagged by clamd is never written to destDir/img.
+func shouldCopyImageClamAV(path string) bool {
+	if err := scanFileForClamAV(path); err != nil {
+		logf("%s\n", err)
+		return false
+	}
+	return true
+}
+
 func copyImages(book *Book) {
 	src := filepath.Join(book.NotionCacheDir, "img")
 	if !u.DirExists(src) {
 		return
 	}
 	dst := filepath.Join(book.destDir(), "img")
-	u.DirCopyRecurMust(dst, src, nil)
+	u.DirCopyRecurMust(dst, src, shouldCopyImageClamAV)
 }
 
 func isPreview() bool {
@@ -94,6 +116,14 @@ var (
 	flgDisableNotionCache bool
 
 	gDestDir string
+
+	// gFileCaches holds the configured cache buckets (notion, gists, images)
+	// loaded from caches.toml, if present. See filecache.go.
+	gFileCaches *FileCacheSet
+
+	// gArchiveFormat is the container format used when writing a bundle of
+	// server output to an archive (see archive.go), set from -archive-format.
+	gArchiveFormat ArchiveFormat = ArchiveFormatZip
 )
 
 func main() {
@@ -103,6 +133,13 @@ func main() {
 		flgAllBooks     bool
 		flgWc           bool
 		flgDownloadGist string
+		flgJobs             int
+		flgSilent           bool
+		flgContentAddressed bool
+		flgVerifyDir        string
+		flgArchiveFormat    string
+		flgArchiveOut       string
+		flgGenOut           string
 	)
 
 	{
@@ -113,6 +150,17 @@ func main() {
 		indexDestDir = filepath.Join(gDestDir, "www")
 	}
 
+	{
+		cacheDir, err := filepath.Abs("cache")
+		must(err)
+		vars := map[string]string{
+			"cacheDir": cacheDir,
+			"bookDir":  filepath.Join(cacheDir, "books"),
+		}
+		gFileCaches, err = loadFileCacheSet("caches.toml", vars)
+		must(err)
+	}
+
 	{
 		flag.BoolVar(&flgWc, "wc", false, "wc -l")
 		flag.BoolVar(&flgDeployProd, "deploy-prod", false, "deploy to prodution")
@@ -125,7 +173,18 @@ func main() {
 		flag.BoolVar(&flgDownloadOnly, "download-only", false, "only download the books from notion (no eval, no html generation")
 		flag.StringVar(&flgDownloadGist, "download-gist", "", "id of the gist to (re)download. Must also provide a book")
 		flag.BoolVar(&flgDisableNotionCache, "no-cache", false, "if true, disables cache for notion")
+		flag.IntVar(&flgJobs, "j", 1, "number of books to download/generate concurrently")
+		flag.BoolVar(&flgSilent, "silent", false, "if true, disables the progress bar display")
+		flag.BoolVar(&flgContentAddressed, "content-addressed", false, "if true, -gen-out writes a content-addressed tree with a manifest.json")
+		flag.StringVar(&flgVerifyDir, "verify", "", "verify a previously generated content-addressed tree at this dir against its manifest.json")
+		flag.StringVar(&flgArchiveFormat, "archive-format", "zip", "archive format for zipped/archived output: zip, tar.gz, or tar.zst")
+		flag.StringVar(&flgArchiveOut, "archive-out", "", "if set, write generated books as a single archive (see -archive-format) to this path instead of a directory")
+		flag.StringVar(&flgGenOut, "gen-out", "", "if set, write generated books as a directory tree at this path (see -content-addressed) instead of the normal -gen flow")
+		flag.StringVar(&flgClamAVAddr, "clamav-addr", "", "host:port of a clamd daemon to scan downloaded gists/images with (or set CLAMAV_ADDR)")
+		flag.StringVar(&flgHighlightStyle, "highlight-style", flgHighlightStyle, "chroma style used for server-side code highlighting")
 		flag.Parse()
+		gArchiveFormat = archiveFormatFromFlag(flgArchiveFormat)
+		initClamAV(flgClamAVAddr)
 
 		// change to true for easier ad-hoc debugging in visual studio code
 		if false {
@@ -153,7 +212,11 @@ func main() {
 
 	timeStart := time.Now()
 	defer func() {
-		logf("Downloaded %d pages, %d from cache. Total time: %s\n", nTotalDownloaded, nTotalFromCache, time.Since(timeStart))
+		logf("Downloaded %d pages, %d from cache. Total time: %s\n", atomic.LoadInt32(&nTotalDownloaded), atomic.LoadInt32(&nTotalFromCache), time.Since(timeStart))
+		if nInfectedAssets > 0 {
+			logf("%d asset(s) rejected by clamav\n", nInfectedAssets)
+			os.Exit(1)
+		}
 	}()
 
 	{
@@ -177,6 +240,18 @@ func main() {
 		return
 	}
 
+	if flgVerifyDir != "" {
+		errs := VerifyManifestDir(flgVerifyDir)
+		if len(errs) == 0 {
+			logf("verify: '%s' matches its manifest.json\n", flgVerifyDir)
+			return
+		}
+		for _, err := range errs {
+			logf("verify: %s\n", err)
+		}
+		os.Exit(1)
+	}
+
 	if flgWc {
 		doLineCount()
 		return
@@ -203,6 +278,25 @@ func main() {
 
 	if flgGen {
 		n := len(booksToProcess)
+		if flgJobs > 1 {
+			mb := newBooksMultiBar(booksToProcess, flgSilent)
+			downloadResults := downloadBooksParallel(booksToProcess, flgJobs, mb)
+			if reportBookErrors(downloadResults) {
+				os.Exit(1)
+			}
+			if flgDownloadOnly {
+				return
+			}
+			updateGeneratedRepo()
+			buildFrontend()
+			must(writeChromaCSS(filepath.Join("www", "gen"), flgHighlightStyle))
+			genResults := genBooksParallel(booksToProcess, flgJobs, mb)
+			if reportBookErrors(genResults) {
+				os.Exit(1)
+			}
+			genBooksIndex(allBooks)
+			return
+		}
 		for i, book := range booksToProcess {
 			initBook(book)
 			downloadBook(book)
@@ -213,6 +307,7 @@ func main() {
 		}
 		updateGeneratedRepo()
 		buildFrontend()
+		must(writeChromaCSS(filepath.Join("www", "gen"), flgHighlightStyle))
 		for i, book := range booksToProcess {
 			genBook(book)
 			fmt.Printf("generated book %d out of %d, name: %s, dir: %s\n", i+1, n, book.Title, book.DirShort)
@@ -222,8 +317,18 @@ func main() {
 		return
 	}
 
+	if flgArchiveOut != "" {
+		genToArchive(booksToProcess, flgArchiveOut, gArchiveFormat)
+		return
+	}
+
+	if flgGenOut != "" {
+		genToDir(booksToProcess, flgGenOut, flgContentAddressed)
+		return
+	}
+
 	if flgPreview {
-		previewWebsite()
+		previewWebsite(booksToProcess)
 	}
 
 	flag.Usage()
@@ -241,18 +346,18 @@ func newNotionClient() *notionapi.Client {
 func downloadSingleGist(book *Book, gistID string) {
 	bookName := book.DirShort
 	logf("Downloading gist '%s' and storing in the cache for the book '%s'\n", gistID, bookName)
-	cache := loadCache(book)
 	gist := gistDownloadMust(gistID)
-	didChange := cache.saveGist(gistID, gist.Raw)
-	if didChange {
-		logf("Saved a new or updated version of gist\n")
+	if err := scanForClamAV(gist.Raw, fmt.Sprintf("gist:%s", gistID)); err != nil {
+		logf("%s\n", err)
 		return
 	}
-	logf("Gist didn't change!\n")
-}
-
-func previewWebsite() {
-	panic("previewWebsite NYI")
+	existing, hadCached := book.gistCache.Get(gistID)
+	if hadCached && string(existing) == string(gist.Raw) {
+		logf("Gist didn't change!\n")
+		return
+	}
+	must(book.gistCache.Put(gistID, gist.Raw))
+	logf("Saved a new or updated version of gist\n")
 }
 
 func updateGeneratedRepo() {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kjk/cheatsheets/pkg/server"
+)
+
+// ManifestEntry describes one logical URI in a content-addressed output
+// tree: where it actually landed on disk (HashedPath), and enough to
+// verify it wasn't tampered with or corrupted in transit.
+type ManifestEntry struct {
+	HashedPath  string `json:"hashedPath"`
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+// Manifest maps a logical URI (as served, e.g. "/s/bundle.css") to where it
+// was written under the content-addressed "assets/" layout.
+type Manifest struct {
+	Entries map[string]ManifestEntry `json:"entries"`
+}
+
+const manifestFileName = "manifest.json"
+
+func isHTMLURI(uri string) bool {
+	return strings.HasSuffix(uri, ".html") || strings.HasSuffix(uri, "/") || uri == ""
+}
+
+// hashedAssetName returns the content-addressed name for uri given its
+// data, e.g. "assets/3a7bd3e2f1c0-bundle.css".
+func hashedAssetName(uri string, data []byte) string {
+	sum := sha256.Sum256(data)
+	hexSum := hex.EncodeToString(sum[:])
+	prefix := hexSum[:12]
+	name := path.Base(uri)
+	return path.Join("assets", fmt.Sprintf("%s-%s", prefix, name))
+}
+
+// newURIReplacer returns a strings.Replacer that substitutes every
+// original URI in rewrite with its hashed path in one simultaneous scan,
+// trying longer URIs first. strings.Replacer tries its pairs in argument
+// order at each match position, so listing the longest URIs first stops
+// one URI that's a prefix of another (e.g. "/s/bundle.js" vs
+// "/s/bundle.js.map") from being substituted first and corrupting the
+// longer one - unlike looping strings.ReplaceAll over rewrite, whose map
+// iteration order is random.
+func newURIReplacer(rewrite map[string]string) *strings.Replacer {
+	origs := make([]string, 0, len(rewrite))
+	for orig := range rewrite {
+		origs = append(origs, orig)
+	}
+	sort.Slice(origs, func(i, j int) bool { return len(origs[i]) > len(origs[j]) })
+	pairs := make([]string, 0, 2*len(origs))
+	for _, orig := range origs {
+		pairs = append(pairs, orig, rewrite[orig])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// WriteServerFilesToDirCAS writes handlers' content to dir using a
+// content-addressed layout: every non-HTML asset (CSS/JS/images) is written
+// to assets/<sha256-prefix>-<name> and every occurrence of its original URI
+// inside HTML output is rewritten to that hashed path. A manifest.json
+// mapping logical URI -> hashed path + sha256 + size + content-type is
+// written alongside. This makes the output deterministic and cache-bustable:
+// downstream CDNs can set an immutable Cache-Control on the hashed paths
+// while HTML stays short-lived.
+func WriteServerFilesToDirCAS(dir string, handlers []server.Handler) (nFiles int, totalSize int64, err error) {
+	type entry struct {
+		uri  string
+		data []byte
+	}
+	var all []entry
+	server.IterContent(handlers, func(uri string, d []byte) {
+		cp := make([]byte, len(d))
+		copy(cp, d)
+		all = append(all, entry{uri: uri, data: cp})
+	})
+
+	rewrite := map[string]string{} // original uri -> hashed uri
+	manifest := &Manifest{Entries: map[string]ManifestEntry{}}
+
+	for _, e := range all {
+		if isHTMLURI(e.uri) {
+			continue
+		}
+		hashed := "/" + hashedAssetName(e.uri, e.data)
+		rewrite[e.uri] = hashed
+	}
+
+	// writeFile writes data to uri (the hashed path for assets) and records
+	// it in the manifest under logicalURI, the URI as originally served.
+	writeFile := func(logicalURI, uri string, data []byte) error {
+		name := strings.TrimPrefix(uri, "/")
+		name = filepath.FromSlash(name)
+		fpath := filepath.Join(dir, name)
+		if mkErr := os.MkdirAll(filepath.Dir(fpath), 0755); mkErr != nil {
+			return mkErr
+		}
+		if wErr := ioutil.WriteFile(fpath, data, 0644); wErr != nil {
+			return wErr
+		}
+		sum := sha256.Sum256(data)
+		manifest.Entries[logicalURI] = ManifestEntry{
+			HashedPath:  uri,
+			SHA256:      hex.EncodeToString(sum[:]),
+			Size:        int64(len(data)),
+			ContentType: mimeTypeFromFileName(logicalURI),
+		}
+		nFiles++
+		totalSize += int64(len(data))
+		atomic.AddInt64(&nTotalFilesWritten, 1)
+		atomic.AddInt64(&nTotalBytesWritten, int64(len(data)))
+		return nil
+	}
+
+	htmlRewriter := newURIReplacer(rewrite)
+
+	for _, e := range all {
+		data := e.data
+		uri := e.uri
+		if hashed, ok := rewrite[uri]; ok {
+			uri = hashed
+		} else if isHTMLURI(uri) {
+			data = []byte(htmlRewriter.Replace(string(data)))
+		}
+		if err = writeFile(e.uri, uri, data); err != nil {
+			return nFiles, totalSize, err
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nFiles, totalSize, err
+	}
+	manifestPath := filepath.Join(dir, manifestFileName)
+	if err = ioutil.WriteFile(manifestPath, manifestData, 0644); err != nil {
+		return nFiles, totalSize, err
+	}
+	nFiles++
+	totalSize += int64(len(manifestData))
+	return nFiles, totalSize, nil
+}
+
+func loadManifest(dir string) (*Manifest, error) {
+	d, err := ioutil.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// VerifyManifestDir walks a previously generated content-addressed tree and
+// re-checks every file against manifest.json's recorded hash, returning one
+// error per file whose content drifted (wrong size, missing, or hash
+// mismatch) rather than stopping at the first problem.
+func VerifyManifestDir(dir string) []error {
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return []error{fmt.Errorf("VerifyManifestDir: failed to load manifest: %w", err)}
+	}
+
+	var errs []error
+	for uri, entry := range manifest.Entries {
+		fpath := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(entry.HashedPath, "/")))
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", uri, err))
+			continue
+		}
+		if int64(len(data)) != entry.Size {
+			errs = append(errs, fmt.Errorf("%s: size drift: manifest says %d, on disk %d", uri, entry.Size, len(data)))
+			continue
+		}
+		sum := sha256.Sum256(data)
+		got := hex.EncodeToString(sum[:])
+		if got != entry.SHA256 {
+			errs = append(errs, fmt.Errorf("%s: sha256 drift: manifest says %s, on disk %s", uri, entry.SHA256, got))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// MarkdownPage is a BookPage sourced from a single CommonMark file with an
+// optional frontmatter block, rather than from a Notion page. It's the
+// seam for community-contributed chapters authored and reviewed as PRs
+// instead of edited in Notion.
+type MarkdownPage struct {
+	title      string
+	id         string // frontmatter "id", defaulting to the file's path relative to its book's markdown root, without ".md"
+	url        string
+	body       []byte // raw markdown, with any frontmatter stripped
+	lastEdited time.Time
+	children   []BookPage
+}
+
+func (p *MarkdownPage) Title() string            { return p.title }
+func (p *MarkdownPage) ID() string                { return p.id }
+func (p *MarkdownPage) URL() string               { return p.url }
+func (p *MarkdownPage) Headings() []*HeadingInfo  { return nil }
+func (p *MarkdownPage) Images() []string          { return nil }
+func (p *MarkdownPage) LastEdited() time.Time     { return p.lastEdited }
+func (p *MarkdownPage) Children() []BookPage      { return p.children }
+
+// markdownRenderer routes fenced code blocks through codeTemplateFunc (the
+// same chroma pipeline Notion code blocks use) and everything else through
+// goldmark's normal HTML renderer.
+var markdownRenderer = goldmark.New(
+	goldmark.WithRenderer(renderer.NewRenderer(renderer.WithNodeRenderers(
+		util.Prioritized(goldmarkhtml.NewRenderer(goldmarkhtml.WithUnsafe()), 1000),
+		util.Prioritized(&chromaCodeBlockRenderer{}, 500),
+	))),
+)
+
+func (p *MarkdownPage) RenderHTML(w io.Writer) error {
+	return markdownRenderer.Convert(p.body, w)
+}
+
+var _ BookPage = (*MarkdownPage)(nil)
+
+// chromaCodeBlockRenderer overrides goldmark's fenced-code-block rendering
+// to call codeTemplateFunc instead of emitting an unhighlighted <pre><code>.
+type chromaCodeBlockRenderer struct{}
+
+func (r *chromaCodeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func (r *chromaCodeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	node := n.(*ast.FencedCodeBlock)
+	lang := ""
+	if l := node.Language(source); l != nil {
+		lang = string(l)
+	}
+	var buf bytes.Buffer
+	for i := 0; i < node.Lines().Len(); i++ {
+		line := node.Lines().At(i)
+		buf.Write(line.Value(source))
+	}
+	_, err := w.WriteString(string(codeTemplateFunc(lang, buf.String())))
+	return ast.WalkSkipChildren, err
+}
+
+const frontmatterDelim = "---\n"
+
+// parseFrontmatter splits a "---\nkey: value\n---\n<body>" file into its
+// flat key/value header and the remaining markdown body. Only simple
+// string values are supported, which is all a page needs (title, id,
+// updated); data with no frontmatter block is returned as the body as-is.
+func parseFrontmatter(data []byte) (map[string]string, []byte) {
+	if !bytes.HasPrefix(data, []byte(frontmatterDelim)) {
+		return nil, data
+	}
+	rest := data[len(frontmatterDelim):]
+	end := bytes.Index(rest, []byte(frontmatterDelim))
+	if end == -1 {
+		return nil, data
+	}
+	header := string(rest[:end])
+	body := rest[end+len(frontmatterDelim):]
+
+	fm := map[string]string{}
+	for _, line := range strings.Split(header, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fm[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return fm, body
+}
+
+// loadMarkdownPage reads and parses a single *.md file at path (rel is its
+// slash-joined path relative to the markdown root, sans ".md", used for
+// id/title defaults and the page's URL).
+func loadMarkdownPage(book *Book, path, rel string) (*MarkdownPage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fm, body := parseFrontmatter(data)
+
+	id := fm["id"]
+	if id == "" {
+		id = rel
+	}
+	title := fm["title"]
+	if title == "" {
+		title = rel
+	}
+	var lastEdited time.Time
+	if s := fm["updated"]; s != "" {
+		lastEdited, _ = time.Parse(time.RFC3339, s)
+	}
+	if lastEdited.IsZero() {
+		if fi, err := os.Stat(path); err == nil {
+			lastEdited = fi.ModTime()
+		}
+	}
+
+	return &MarkdownPage{
+		title:      title,
+		id:         id,
+		url:        book.URL() + rel + ".html",
+		body:       body,
+		lastEdited: lastEdited,
+	}, nil
+}
+
+// loadMarkdownPages walks dir one level of sub-directories deep and
+// returns one MarkdownPage chapter per *.md file directly inside dir,
+// each with its children populated from the *.md files in the
+// like-named sub-directory (if any) as articles. Files nested deeper
+// than that aren't chapters or articles and are skipped. Chapters and,
+// within each chapter, articles are sorted by path so order matches
+// directory order. A file's frontmatter may set "title", "id" (defaults
+// to its slash-joined path relative to dir, without ".md") and "updated" (RFC3339;
+// defaults to the file's mtime). book is used only to build each page's
+// URL under book.URL().
+func loadMarkdownPages(book *Book, dir string) ([]BookPage, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chapterNames []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".md") {
+			chapterNames = append(chapterNames, e.Name())
+		}
+	}
+	sort.Strings(chapterNames)
+
+	var pages []BookPage
+	for _, name := range chapterNames {
+		path := filepath.Join(dir, name)
+		rel := strings.TrimSuffix(name, ".md")
+		chapter, err := loadMarkdownPage(book, path, rel)
+		if err != nil {
+			return nil, err
+		}
+
+		articleDir := filepath.Join(dir, rel)
+		if fi, err := os.Stat(articleDir); err == nil && fi.IsDir() {
+			articleEntries, err := ioutil.ReadDir(articleDir)
+			if err != nil {
+				return nil, err
+			}
+			var articleNames []string
+			for _, e := range articleEntries {
+				if !e.IsDir() && strings.HasSuffix(e.Name(), ".md") {
+					articleNames = append(articleNames, e.Name())
+				}
+			}
+			sort.Strings(articleNames)
+			for _, articleName := range articleNames {
+				articleRel := rel + "/" + strings.TrimSuffix(articleName, ".md")
+				article, err := loadMarkdownPage(book, filepath.Join(articleDir, articleName), articleRel)
+				if err != nil {
+					return nil, err
+				}
+				chapter.children = append(chapter.children, article)
+			}
+		}
+
+		pages = append(pages, chapter)
+	}
+	return pages, nil
+}
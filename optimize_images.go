@@ -1,43 +1,219 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+
+	"github.com/Kagami/go-avif"
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
 )
 
-// run optipng in parallel
-func optimizeWithOptipng(path string) {
-	logf(ctx(), "Optimizing '%s'\n", path)
-	cmd := exec.Command("optipng", "-o5", path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+// responsiveWidths are the sibling widths generated for each image, in
+// addition to a lossless-recompressed copy at its original size (width 0
+// in imageVariant below).
+var responsiveWidths = []int{480, 960, 1600}
+
+// imageVariant is one generated sibling of a source image: either the
+// lossless-recompressed original (Width == 0) or a resized copy, each also
+// available as a WebP and/or AVIF sibling. Paths are file names, relative
+// to the source image's own directory.
+type imageVariant struct {
+	Width    int    `json:"width"`
+	Path     string `json:"path"`
+	WebPPath string `json:"webpPath,omitempty"`
+	AVIFPath string `json:"avifPath,omitempty"`
+}
+
+// imagesManifest maps an image's URL (page.ImageURL(name)) to the variants
+// optimizeImage produced for it. pictureMarkup reads it to know what
+// sizes/formats are available without re-probing the filesystem;
+// FilesHandler does not read it.
+type imagesManifest map[string][]imageVariant
+
+func imagesManifestPath(book *Book) string {
+	return filepath.Join(book.DirCache, "images.json")
+}
+
+func loadImagesManifest(book *Book) imagesManifest {
+	d, err := ioutil.ReadFile(imagesManifestPath(book))
 	if err != nil {
-		// it's ok if fails. some jpeg images are saved as .png
-		// which trips it
-		logf(ctx(), "optipng failed with '%s'\n", err)
+		return imagesManifest{}
 	}
+	m := imagesManifest{}
+	if err := json.Unmarshal(d, &m); err != nil {
+		logf("loadImagesManifest: '%s': %s\n", imagesManifestPath(book), err)
+		return imagesManifest{}
+	}
+	return m
 }
 
-func maybeOptimizeImage(path string) {
-	ext := filepath.Ext(path)
-	ext = strings.ToLower(ext)
+func saveImagesManifest(book *Book) error {
+	book.muImagesManifest.Lock()
+	d, err := json.MarshalIndent(book.imagesManifest, "", "  ")
+	book.muImagesManifest.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(imagesManifestPath(book), d, 0644)
+}
+
+// recordImageVariants stores variants for uri in book's in-memory images
+// manifest; call saveImagesManifest to persist it.
+func (b *Book) recordImageVariants(uri string, variants []imageVariant) {
+	b.muImagesManifest.Lock()
+	defer b.muImagesManifest.Unlock()
+	if b.imagesManifest == nil {
+		b.imagesManifest = imagesManifest{}
+	}
+	b.imagesManifest[uri] = variants
+}
+
+// outputExt normalizes what we re-encode a source image as: JPEGs stay
+// JPEGs (lossy recompression at a high quality is the "lossless enough"
+// option for photos), everything else (PNG, TIFF, BMP) becomes PNG.
+func outputExt(srcExt string) string {
+	switch strings.ToLower(srcExt) {
+	case ".jpg", ".jpeg":
+		return ".jpg"
+	default:
+		return ".png"
+	}
+}
+
+// isOptimizableImage reports whether path is a format optimizeImage
+// knows how to decode and re-encode.
+func isOptimizableImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".tiff", ".tif", ".bmp":
+		return true
+	}
+	return false
+}
+
+func saveRaster(img image.Image, dstPath, ext string) error {
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 	switch ext {
-	// TODO: for .gif requires -snip
-	case ".png", ".tiff", ".tif", "bmp":
-		optimizeWithOptipng(path)
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(f, img, &jpeg.Options{Quality: 92})
+	default:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		return enc.Encode(f, img)
 	}
 }
 
-func optimizeAllImages() {
-	// verify we have optipng installed
-	cmd := exec.Command("optipng", "-h")
-	err := cmd.Run()
-	panicIf(err != nil, "optipng is not installed")
+func saveWebP(img image.Image, dstPath string) error {
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return webp.Encode(f, img, &webp.Options{Quality: 85})
+}
 
+func saveAVIF(img image.Image, dstPath string) error {
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return avif.Encode(f, img, &avif.Options{Quality: 60})
+}
+
+// saveVariant writes img (the lossless-recompressed original, or one
+// resized width) plus its WebP/AVIF siblings, all named after base+suffix
+// in srcDir, and returns the recorded imageVariant.
+func saveVariant(img image.Image, srcDir, base, suffix, ext string, width int) imageVariant {
+	name := base + suffix + ext
+	v := imageVariant{Width: width, Path: name}
+	if err := saveRaster(img, filepath.Join(srcDir, name), ext); err != nil {
+		logf("saveVariant: raster encode failed for '%s': %s\n", name, err)
+		return v
+	}
+	webpName := base + suffix + ".webp"
+	if err := saveWebP(img, filepath.Join(srcDir, webpName)); err != nil {
+		logf("saveVariant: webp encode failed for '%s': %s\n", webpName, err)
+	} else {
+		v.WebPPath = webpName
+	}
+	avifName := base + suffix + ".avif"
+	if err := saveAVIF(img, filepath.Join(srcDir, avifName)); err != nil {
+		logf("saveVariant: avif encode failed for '%s': %s\n", avifName, err)
+	} else {
+		v.AVIFPath = avifName
+	}
+	return v
+}
+
+// optimizeImage replaces the old optipng shell-out: it decodes srcPath and
+// writes a lossless-recompressed original plus a set of responsive widths
+// (see responsiveWidths), each with WebP/AVIF siblings, next to srcPath.
+// Non-raster formats (.gif, .svg, ...) are left untouched and return nil.
+func optimizeImage(srcPath string) ([]imageVariant, error) {
+	if !isOptimizableImage(srcPath) {
+		return nil, nil
+	}
+
+	src, err := imaging.Open(srcPath, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("optimizeImage: failed to open '%s': %w", srcPath, err)
+	}
+
+	srcExt := filepath.Ext(srcPath)
+	ext := outputExt(srcExt)
+	srcDir := filepath.Dir(srcPath)
+	base := strings.TrimSuffix(filepath.Base(srcPath), srcExt)
+
+	variants := []imageVariant{saveVariant(src, srcDir, base, "", ext, 0)}
+
+	srcWidth := src.Bounds().Dx()
+	for _, w := range responsiveWidths {
+		if w >= srcWidth {
+			continue
+		}
+		resized := imaging.Resize(src, w, 0, imaging.Lanczos)
+		suffix := fmt.Sprintf("-%d", w)
+		variants = append(variants, saveVariant(resized, srcDir, base, suffix, ext, w))
+	}
+	return variants, nil
+}
+
+// optimizeBookPageImages runs optimizeImage over every image page refers
+// to and records the result in book's images.json manifest. Called from
+// afterPageDownload, so it naturally runs inside whatever concurrency gate
+// wraps downloadBook (booksSem in the preview server, the -j worker pool
+// otherwise) rather than needing one of its own.
+func optimizeBookPageImages(book *Book, page *Page) {
+	for _, imagePath := range page.images {
+		imageName := filepath.Base(imagePath)
+		srcPath := filepath.Join(book.NotionCacheDir, "img", imageName)
+		variants, err := optimizeImage(srcPath)
+		if err != nil {
+			logf("optimizeBookPageImages: %s\n", err)
+			continue
+		}
+		if variants == nil {
+			continue
+		}
+		book.recordImageVariants(page.ImageURL(imageName), variants)
+	}
+}
+
+// optimizeAllImages is the ad-hoc, whole-tree equivalent of
+// optimizeBookPageImages, for one-off cleanups outside the normal
+// per-book pipeline (see the "ad-hoc, rarely done tasks" block in main).
+func optimizeAllImages() {
 	dirsToVisit := []string{"."}
 	for len(dirsToVisit) > 0 {
 		dir := dirsToVisit[0]
@@ -55,7 +231,9 @@ func optimizeAllImages() {
 				}
 				continue
 			}
-			maybeOptimizeImage(path)
+			if _, err := optimizeImage(path); err != nil {
+				logf("optimizeAllImages: %s\n", err)
+			}
 		}
 	}
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/kjk/programming-books.io/pkg/memcache"
+)
+
+// maxPageCacheBytes bounds the LRU by entry size; PROGRAMMING_BOOKS_MEMORY_LIMIT
+// (see pkg/memcache) additionally bounds it by a fraction of system memory,
+// so a run with many large books can't balloon resident memory regardless
+// of how generous this constant is.
+const maxPageCacheBytes = 256 * 1024 * 1024
+
+// gPageCache holds rendered page HTML (and, as other producers are wired
+// up, TOC/app.js blobs and per-page image-path resolution results) across
+// all books being previewed/generated in this process. See genBookHandler.
+var (
+	gPageCache        *memcache.Cache
+	initPageCacheOnce sync.Once
+)
+
+// initPageCache lazily constructs gPageCache exactly once. highlightCode
+// calls this on every single highlight request, and with -j>1 several
+// books' chroma pipelines can hit it concurrently on first use, so a bare
+// nil check isn't safe here: sync.Once is what makes the first caller's
+// *memcache.Cache the only one that's ever built or seen.
+func initPageCache() {
+	initPageCacheOnce.Do(func() {
+		gPageCache = memcache.NewFromEnv(maxPageCacheBytes)
+	})
+}
+
+// pageCacheKey namespaces uri by book, since gPageCache is shared across
+// every book being served.
+func pageCacheKey(book *Book, uri string) string {
+	return book.DirShort + "|" + uri
+}
+
+// serveDebugCache renders the /_debug/cache endpoint: hit/miss/eviction
+// counters and current size for the shared page cache.
+func serveDebugCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if gPageCache == nil {
+		fmt.Fprint(w, "page cache not initialized\n")
+		return
+	}
+	s := gPageCache.Stats()
+	fmt.Fprintf(w, "entries:    %d\n", s.Entries)
+	fmt.Fprintf(w, "used bytes: %d\n", s.UsedBytes)
+	fmt.Fprintf(w, "max bytes:  %d\n", s.MaxBytes)
+	fmt.Fprintf(w, "hits:       %d\n", s.Hits)
+	fmt.Fprintf(w, "misses:     %d\n", s.Misses)
+	fmt.Fprintf(w, "evictions:  %d\n", s.Evictions)
+	fmt.Fprintf(w, "heap inuse: %d\n", s.HeapInuse)
+	fmt.Fprintf(w, "heap limit: %d (PROGRAMMING_BOOKS_MEMORY_LIMIT)\n", s.HeapLimit)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pictureMarkup builds a <picture> element for imageName using the
+// responsive-width and WebP/AVIF variants optimizeBookPageImages recorded
+// in book's images manifest, so browsers pick the smallest format/size
+// they support. It falls back to a plain <img> if imageName has no
+// recorded variants (e.g. an unsupported source format like .gif).
+//
+// Not yet called: notionToHTML, the one place that emits <img> tags for a
+// Notion page's embedded images, isn't part of this source tree (its
+// definition lives elsewhere in the real repo), so this can't be wired in
+// from here. Whoever owns notionToHTML needs to call this in place of its
+// current <img> output.
+func pictureMarkup(book *Book, page *Page, imageName, alt string) template.HTML {
+	uri := page.ImageURL(imageName)
+	book.muImagesManifest.Lock()
+	variants := book.imagesManifest[uri]
+	book.muImagesManifest.Unlock()
+
+	if len(variants) == 0 {
+		return template.HTML(fmt.Sprintf(`<img src="%s" alt="%s" loading="lazy">`,
+			template.HTMLEscapeString(uri), template.HTMLEscapeString(alt)))
+	}
+
+	dir := filepath.Dir(uri)
+	variantURL := func(name string) string { return path.Join(dir, name) }
+
+	srcset := func(pick func(v imageVariant) string) string {
+		var parts []string
+		for _, v := range variants {
+			if v.Width == 0 {
+				continue
+			}
+			if name := pick(v); name != "" {
+				parts = append(parts, fmt.Sprintf("%s %dw", variantURL(name), v.Width))
+			}
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ", ")
+	}
+
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	if s := srcset(func(v imageVariant) string { return v.AVIFPath }); s != "" {
+		fmt.Fprintf(&b, "  <source type=\"image/avif\" srcset=\"%s\">\n", s)
+	}
+	if s := srcset(func(v imageVariant) string { return v.WebPPath }); s != "" {
+		fmt.Fprintf(&b, "  <source type=\"image/webp\" srcset=\"%s\">\n", s)
+	}
+	// variants[0] is always the Width==0 (lossless-recompressed original)
+	// entry: optimizeImage appends it before any resized width.
+	fmt.Fprintf(&b, "  <img src=\"%s\" alt=\"%s\" loading=\"lazy\">\n",
+		variantURL(variants[0].Path), template.HTMLEscapeString(alt))
+	b.WriteString("</picture>")
+	return template.HTML(b.String())
+}
@@ -0,0 +1,152 @@
+// Package clamav is a minimal client for clamd's INSTREAM protocol, used to
+// optionally scan downloaded assets (gists, images) before they're written
+// into a cache or destination dir.
+package clamav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client talks to a clamd daemon over its TCP socket (host:port).
+type Client struct {
+	Addr string
+	// Timeout bounds both connecting and the whole scan round-trip, so a
+	// slow/unreachable clamd can't stall the whole build. Mirrors
+	// newTimeoutClient's connect+read/write timeout pairing.
+	Timeout time.Duration
+}
+
+// NewClient returns a Client with a sane default timeout.
+func NewClient(addr string, timeout time.Duration) *Client {
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{Addr: addr, Timeout: timeout}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	return conn, nil
+}
+
+// Ping checks that clamd is reachable and responding.
+func (c *Client) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\000")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = strings.TrimRight(line, "\000")
+	if line != "PONG" {
+		return fmt.Errorf("clamav: unexpected PING response: %q", line)
+	}
+	return nil
+}
+
+// ScanResult is the outcome of an InStream scan.
+type ScanResult struct {
+	// Infected is true if clamd reported a signature match.
+	Infected bool
+	// Signature is the name of the matched signature, if Infected.
+	Signature string
+	// Raw is clamd's raw response line, useful for logging.
+	Raw string
+}
+
+// InStream streams r to clamd's INSTREAM command and returns whether it
+// was flagged as infected. clamd expects each chunk prefixed with its
+// length as a 4-byte big-endian integer, terminated by a zero-length
+// chunk.
+func (c *Client) InStream(r io.Reader) (ScanResult, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\000")); err != nil {
+		return ScanResult{}, err
+	}
+
+	buf := make([]byte, 64*1024)
+	lenBuf := make([]byte, 4)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(lenBuf, uint32(n))
+			if _, err := conn.Write(lenBuf); err != nil {
+				return ScanResult{}, err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return ScanResult{}, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+	// terminating zero-length chunk
+	binary.BigEndian.PutUint32(lenBuf, 0)
+	if _, err := conn.Write(lenBuf); err != nil {
+		return ScanResult{}, err
+	}
+
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	line = strings.TrimRight(line, "\000\n")
+	return parseScanResponse(line)
+}
+
+// parseScanResponse parses a line like:
+//
+//	stream: OK
+//	stream: Eicar-Test-Signature FOUND
+//	stream: <error message> ERROR
+//
+// A response ending in neither "OK" nor "FOUND" - most commonly "ERROR"
+// (stream-size-limit exceeded, malformed request, clamd overloaded, ...) -
+// means the scan didn't happen, so it's returned as an error rather than
+// as ScanResult{Infected: false}: callers must not treat "couldn't scan"
+// as "scanned clean".
+func parseScanResponse(line string) (ScanResult, error) {
+	res := ScanResult{Raw: line}
+	switch {
+	case strings.HasSuffix(line, "OK"):
+		// not infected
+	case strings.HasSuffix(line, "FOUND"):
+		res.Infected = true
+		s := strings.TrimSuffix(line, "FOUND")
+		if i := strings.Index(s, ":"); i >= 0 {
+			s = s[i+1:]
+		}
+		res.Signature = strings.TrimSpace(s)
+	default:
+		return ScanResult{}, fmt.Errorf("clamav: scan failed: %q", line)
+	}
+	return res, nil
+}
@@ -0,0 +1,250 @@
+// Package memcache is a small, process-wide, memory-bounded LRU cache for
+// derived data that's expensive to recompute but cheap to regenerate from
+// source: rendered page HTML, TOC/app.js blobs, image-path resolution
+// results, and similar. It exists so a preview server juggling many large
+// books doesn't keep every render it has ever produced resident forever.
+package memcache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Entry is one cached value. Generation is an opaque counter supplied by
+// the caller (e.g. a dependency graph's per-URL generation number) so a
+// hit can be reported alongside the generation it was produced at; Cache
+// itself never interprets it.
+type Entry struct {
+	Value      []byte
+	Generation int64
+}
+
+type element struct {
+	key   string
+	entry Entry
+	size  int64
+}
+
+// Stats is a snapshot of a Cache's counters, suitable for an introspection
+// endpoint like /_debug/cache.
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	UsedBytes int64
+	MaxBytes  int64
+	HeapLimit int64
+	HeapInuse int64
+}
+
+// Cache is an LRU cache bounded by both an explicit byte budget and a
+// fraction of system memory measured via runtime.MemStats.HeapInuse,
+// whichever is hit first. Safe for concurrent use.
+type Cache struct {
+	mu sync.Mutex
+
+	ll    *list.List
+	items map[string]*list.Element
+
+	maxBytes  int64
+	heapLimit int64 // evict, regardless of maxBytes, once HeapInuse crosses this
+	usedBytes int64
+
+	hits, misses, evictions int64
+}
+
+// New returns a Cache that evicts once its entries exceed maxBytes or the
+// process's HeapInuse exceeds heapLimit, whichever comes first. Pass 0 for
+// heapLimit to disable the HeapInuse check.
+func New(maxBytes, heapLimit int64) *Cache {
+	return &Cache{
+		ll:        list.New(),
+		items:     map[string]*list.Element{},
+		maxBytes:  maxBytes,
+		heapLimit: heapLimit,
+	}
+}
+
+// NewFromEnv returns a Cache sized from PROGRAMMING_BOOKS_MEMORY_LIMIT
+// (bytes, with an optional k/m/g suffix, e.g. "512M"), falling back to a
+// quarter of total system memory the way Hugo's HUGO_MEMORYLIMIT does, or
+// a conservative fixed default if system memory can't be determined. The
+// byte budget for entries themselves is maxBytes, independent of the env
+// var, which only governs the HeapInuse safety valve.
+func NewFromEnv(maxBytes int64) *Cache {
+	return New(maxBytes, heapLimitFromEnv())
+}
+
+const envMemoryLimit = "PROGRAMMING_BOOKS_MEMORY_LIMIT"
+
+const defaultHeapLimit = 512 * 1024 * 1024 // used only if system memory can't be read
+
+func heapLimitFromEnv() int64 {
+	if s := strings.TrimSpace(os.Getenv(envMemoryLimit)); s != "" {
+		if n, err := parseByteSize(s); err == nil && n > 0 {
+			return n
+		}
+	}
+	if total := systemMemoryBytes(); total > 0 {
+		return total / 4
+	}
+	return defaultHeapLimit
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "GB"):
+		mult = 1 << 30
+		s = strings.TrimSuffix(s, "GB")
+	case strings.HasSuffix(s, "MB"):
+		mult = 1 << 20
+		s = strings.TrimSuffix(s, "MB")
+	case strings.HasSuffix(s, "KB"):
+		mult = 1 << 10
+		s = strings.TrimSuffix(s, "KB")
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+		s = strings.TrimSuffix(s, "G")
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+		s = strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+		s = strings.TrimSuffix(s, "K")
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// systemMemoryBytes returns total system memory on Linux by reading
+// /proc/meminfo, or 0 if it can't be determined (e.g. non-Linux, or the
+// file is missing/unparseable).
+func systemMemoryBytes() int64 {
+	d, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(d), "\n") {
+		if !strings.HasPrefix(line, "MemTotal:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
+
+// entrySize approximates an entry's footprint: the value plus a fixed
+// overhead for the key and bookkeeping, good enough for eviction decisions
+// without requiring exact accounting.
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key)) + int64(len(value)) + 64
+}
+
+// Get returns the cached value and generation for key, if present. A hit
+// moves key to the front of the LRU list.
+func (c *Cache) Get(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return Entry{}, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*element).entry, true
+}
+
+// Put inserts or replaces key's entry and evicts from the back of the LRU
+// list until the cache is back under budget.
+func (c *Cache) Put(key string, value []byte, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	size := entrySize(key, value)
+	if el, ok := c.items[key]; ok {
+		old := el.Value.(*element)
+		c.usedBytes += size - old.size
+		old.entry = Entry{Value: value, Generation: generation}
+		old.size = size
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&element{key: key, entry: Entry{Value: value, Generation: generation}, size: size})
+		c.items[key] = el
+		c.usedBytes += size
+	}
+	c.evictLocked()
+}
+
+// Delete removes key, if present.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+func (c *Cache) removeLocked(el *list.Element) {
+	e := el.Value.(*element)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.usedBytes -= e.size
+}
+
+// evictLocked drops least-recently-used entries while the cache is over
+// its byte budget or the process's HeapInuse is over the configured
+// fraction of system memory. Must be called with c.mu held.
+func (c *Cache) evictLocked() {
+	overHeap := c.heapLimit > 0 && heapInuse() > c.heapLimit
+	for (c.maxBytes > 0 && c.usedBytes > c.maxBytes) || overHeap {
+		back := c.ll.Back()
+		if back == nil {
+			return
+		}
+		c.removeLocked(back)
+		c.evictions++
+		overHeap = c.heapLimit > 0 && heapInuse() > c.heapLimit
+	}
+}
+
+func heapInuse() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse)
+}
+
+// Stats returns a snapshot of the cache's counters and current size.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.ll.Len(),
+		UsedBytes: c.usedBytes,
+		MaxBytes:  c.maxBytes,
+		HeapLimit: c.heapLimit,
+		HeapInuse: heapInuse(),
+	}
+}
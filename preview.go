@@ -1,14 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
 	"html/template"
 	"io"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -82,45 +82,6 @@ func isFullURL(uri string) bool {
 	return strings.HasPrefix(uri, "https://") || strings.HasPrefix(uri, "http://")
 }
 
-func addSitemapURL(b *Book, uri string) {
-	if !isFullURL(uri) {
-		uri = urlJoin(siteBaseURL, uri)
-	}
-	b.muSitemapURLS.Lock()
-	b.sitemapURLS[uri] = struct{}{}
-	b.muSitemapURLS.Unlock()
-}
-
-const (
-	sitemapTmpl = `User-agent: *
-Disallow:
-
-Sitemap: %s
-`
-)
-
-func genSitemapHandler(books []*Book) Handler {
-	// http://www.advancedhtml.co.uk/robots-sitemaps.htm
-
-	var urls []string
-	for _, b := range books {
-		addSitemapURL(b, "/")
-		//addSitemapURL(b, "about")
-		for uri := range b.sitemapURLS {
-			urls = append(urls, uri)
-		}
-	}
-	sort.Strings(urls)
-
-	sitemapURL := urlJoin(siteBaseURL, "sitemap.txt")
-	robotsTxt := fmt.Sprintf(sitemapTmpl, sitemapURL)
-	h := NewContentHandler("/robots.txt", []byte(robotsTxt))
-
-	s := strings.Join(urls, "\n")
-	h.Add("/sitemap.txt", []byte(s))
-	return h
-}
-
 func serveStart(w http.ResponseWriter, r *http.Request, uri string) {
 	if r == nil {
 		return
@@ -200,6 +161,12 @@ func genBooksIndex(books []*Book) []Handler {
 	return res
 }
 
+// previewWebsite runs a live-reload dev server: it serves booksToProcess on
+// MakeHTTPServer/StartHTTPServer, watches the book source directories
+// (Notion cache, covers, shared templates) with fsnotify, regenerates the
+// affected book on change, and pushes a reload to connected browsers over
+// /__reload once regeneration finishes (or shows a build-error overlay in
+// place of the broken content if it failed).
 func previewWebsite(booksToProcess []*Book) {
 	logf(ctx(), "previewWebsite\n")
 	timeStart := time.Now()
@@ -216,6 +183,22 @@ func previewWebsite(booksToProcess []*Book) {
 		logf(ctx(), "previewWebsite: finished %d urls in %s\n", nPages, time.Since(timeStart))
 	}()
 
+	rb := newReloadBroker()
+	reloadGet := func(uri string) func(w http.ResponseWriter, r *http.Request) {
+		if uri != "/__reload" {
+			return nil
+		}
+		return rb.ServeHTTP
+	}
+	reloadURLs := func() []string { return []string{"/__reload"} }
+	server.Handlers = append(server.Handlers, NewDynamicHandler(reloadGet, reloadURLs))
+	watcher, err := watchAndRegenerate(booksToProcess, rb)
+	if err != nil {
+		logf(ctx(), "previewWebsite: fsnotify disabled: %s\n", err)
+	} else {
+		defer watcher.Close()
+	}
+
 	waitSignal := StartServer(server)
 	waitSignal()
 }
@@ -250,7 +233,25 @@ func previewToInsantPreview(booksToProcess []*Book) {
 	logf(ctx(), "previewToInsantPreview: uploaded zip of size %s in %s\n%s\n", formatSize(int64(len(zipData))), time.Since(timeStart), uri)
 }
 
-func genToDir(booksToProcess []*Book, dir string) {
+// genToArchive builds booksToProcess and writes the result as a single
+// archive file in format (see archive.go) rather than a directory tree.
+func genToArchive(booksToProcess []*Book, archivePath string, format ArchiveFormat) {
+	logf(ctx(), "genToArchive: '%s' (%s)\n", archivePath, format)
+	timeStart := time.Now()
+	flgReloadTemplates = false
+	flgNoDownload = true
+	server := buildServer(booksToProcess, false)
+	waitBuildServerDone()
+	logf(ctx(), "genToArchive: finished generating in %s\n", time.Since(timeStart))
+
+	f, err := os.Create(archivePath)
+	must(err)
+	defer f.Close()
+	must(WriteServerFilesToArchive(f, format, server.Handlers, ArchiveOptions{}))
+	logf(ctx(), "genToArchive: wrote '%s'\n", archivePath)
+}
+
+func genToDir(booksToProcess []*Book, dir string, contentAddressed bool) {
 	logf(ctx(), "genToDir: '%s'\n", dir)
 	timeStart := time.Now()
 	flgReloadTemplates = false
@@ -263,6 +264,12 @@ func genToDir(booksToProcess []*Book, dir string) {
 	}
 	logf(ctx(), "genToDir: finished %d urls in %s\n", nPages, time.Since(timeStart))
 	//must(os.RemoveAll(dir))
+	if contentAddressed {
+		nFiles, totalSize, err := WriteServerFilesToDirCAS(dir, server.Handlers)
+		must(err)
+		logf(ctx(), "genToDir: wrote %d content-addressed files of size %s to '%s'\n", nFiles, formatSize(totalSize), dir)
+		return
+	}
 	nFiles, totalSize := WriteServerFilesToDir(dir, server.Handlers)
 	logf(ctx(), "genToDir: wrote %d files of size %s to '%s'\n", nFiles, formatSize(totalSize), dir)
 }
@@ -291,7 +298,10 @@ func genBookHandler(book *Book) Handler {
 	var handlers []Handler
 	var filesHandler *FilesHandler
 	var mu sync.Mutex
-	pages := map[string]*Page{} // maps url to Page
+	pages := map[string]*Page{}        // maps url to Page
+	bookPages := map[string]BookPage{} // maps url to BookPage (e.g. markdown chapters)
+	deps := getOrCreateDepGraph(book)
+	initPageCache()
 
 	addHandler := func(h Handler) {
 		mu.Lock()
@@ -305,16 +315,20 @@ func genBookHandler(book *Book) Handler {
 	indexURL := path.Join(baseURL, "index.html")
 	book404URL := path.Join(baseURL, "404.html")
 	overviewURL := path.Join(baseURL, "overview.html")
+	debugDepsURL := path.Join(baseURL, "_debug", "deps")
 
 	getURLs := func() []string {
 		mu.Lock()
 		defer mu.Unlock()
 		urls := []string{
-			indexURL, book404URL, overviewURL,
+			indexURL, book404URL, overviewURL, debugDepsURL,
 		}
 		for uri := range pages {
 			urls = append(urls, uri)
 		}
+		for uri := range bookPages {
+			urls = append(urls, uri)
+		}
 		for _, h := range handlers {
 			urls = append(urls, h.URLS()...)
 		}
@@ -322,6 +336,15 @@ func genBookHandler(book *Book) Handler {
 	}
 
 	get := func(uri string) func(w http.ResponseWriter, r *http.Request) {
+		if isPreview() {
+			if buildErr := getBookBuildError(book); buildErr != nil {
+				return func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "text/html; charset=utf-8")
+					w.Write(buildErrorOverlayHTML(book, buildErr))
+				}
+			}
+		}
+
 		mu.Lock()
 		defer mu.Unlock()
 
@@ -329,6 +352,7 @@ func genBookHandler(book *Book) Handler {
 		case indexURL:
 			return func(w http.ResponseWriter, r *http.Request) {
 				genBookIndexHTML(book, w)
+				deps.recordDeps(indexURL, []identity{tocIdentity(book), coverIdentity(book)})
 			}
 		case book404URL:
 			return func(w http.ResponseWriter, r *http.Request) {
@@ -337,9 +361,20 @@ func genBookHandler(book *Book) Handler {
 		case overviewURL:
 			d := genOverviewContent(book)
 			return makeServeContent(overviewURL, d)
+		case debugDepsURL:
+			return serveDebugDeps(deps)
 		}
 		if page := pages[uri]; page != nil {
 			return func(w http.ResponseWriter, r *http.Request) {
+				pageID := pageIdentity(page)
+				tmplID := templateIdentity("page.tmpl.html")
+
+				cacheKey := pageCacheKey(book, uri)
+				if cached, isCached := gPageCache.Get(cacheKey); isCached && depsStillFresh(deps, uri, pageID, tmplID) {
+					w.Write(cached.Value)
+					return
+				}
+
 				html := notionToHTML(page, book)
 				page.BodyHTML = template.HTML(string(html))
 				d := PageData{
@@ -348,11 +383,42 @@ func genBookHandler(book *Book) Handler {
 					Description: page.Title,
 				}
 				buildCreadcumb(book, page, &d)
-				path := page.destFilePath()
-				err := execTemplate("page.tmpl.html", d, path, w)
-				if err != nil {
+				var buf bytes.Buffer
+				destPath := page.destFilePath()
+				if err := execTemplate("page.tmpl.html", d, destPath, &buf); err != nil {
 					logf(ctx(), "Failed to generate page %s in book %s\n", page.NotionID, book.Title)
+					return
 				}
+				deps.recordDeps(uri, []identity{pageID, tmplID})
+				gPageCache.Put(cacheKey, buf.Bytes(), deps.currentGeneration(uri))
+				w.Write(buf.Bytes())
+			}
+		}
+		if bp := bookPages[uri]; bp != nil {
+			return func(w http.ResponseWriter, r *http.Request) {
+				var body bytes.Buffer
+				if err := bp.RenderHTML(&body); err != nil {
+					logf(ctx(), "Failed to render markdown page '%s' in book %s\n", bp.ID(), book.Title)
+					return
+				}
+				d := struct {
+					PageCommon
+					Title       string
+					Description string
+					Body        template.HTML
+				}{
+					PageCommon:  getPageCommon(),
+					Title:       bp.Title(),
+					Description: bp.Title(),
+					Body:        template.HTML(body.String()),
+				}
+				destPath := book.bookPageDestPath(uri)
+				var buf bytes.Buffer
+				if err := execTemplate("markdown-page.tmpl.html", d, destPath, &buf); err != nil {
+					logf(ctx(), "Failed to generate markdown page '%s' in book %s\n", bp.ID(), book.Title)
+					return
+				}
+				w.Write(buf.Bytes())
 			}
 		}
 		for _, h := range handlers {
@@ -382,7 +448,9 @@ func genBookHandler(book *Book) Handler {
 
 		buildBookPages(book)
 
-		addSitemapURL(book, book.CanonnicalURL())
+		addSitemapURL(book, book.CanonnicalURL(), time.Time{}, "daily", 1.0)
+		addSitemapURL(book, book.FeedAtomFullURL(), time.Time{}, "daily", 0.3)
+		addSitemapURL(book, book.FeedRSSFullURL(), time.Time{}, "daily", 0.3)
 
 		{
 			dir := filepath.Join(book.NotionCacheDir, "img")
@@ -390,6 +458,7 @@ func genBookHandler(book *Book) Handler {
 			addHandler(NewDirHandler(dir, urlPrefix, nil))
 		}
 		addHandler(genBookTOCSearchHandlerMust(book))
+		addHandler(genBookFeedHandler(book))
 		{
 			// copyCover
 			{
@@ -418,8 +487,8 @@ func genBookHandler(book *Book) Handler {
 
 		{
 			// genPage
-			addPage := func(page *Page) {
-				addSitemapURL(book, page.CanonnicalURL())
+			addPage := func(page *Page, isChapter bool) {
+				addSitemapPageURL(book, page, isChapter)
 				uri := ensureHTMLSuffix(page.URL())
 				pages[uri] = page
 				for _, imagePath := range page.images {
@@ -432,13 +501,32 @@ func genBookHandler(book *Book) Handler {
 
 			mu.Lock()
 			for _, chapter := range book.Chapters() {
-				addPage(chapter)
+				addPage(chapter, true)
 				for _, article := range chapter.Pages {
-					addPage(article)
+					addPage(article, false)
 				}
 			}
 			mu.Unlock()
 		}
+
+		{
+			// genMarkdownPages: books with MarkdownDir set get their
+			// chapters served through the BookPage interface instead of
+			// a Notion-backed *Page.
+			addBookPage := func(bp BookPage, isChapter bool) {
+				addSitemapBookPageURL(book, bp, isChapter)
+				uri := ensureHTMLSuffix(bp.URL())
+				mu.Lock()
+				bookPages[uri] = bp
+				mu.Unlock()
+			}
+			for _, chapter := range book.markdownPages {
+				addBookPage(chapter, true)
+				for _, article := range chapter.Children() {
+					addBookPage(article, false)
+				}
+			}
+		}
 	}()
 	return NewDynamicHandler(get, getURLs)
 }
@@ -463,12 +551,23 @@ func buildServer(booksToProcess []*Book, forDev bool) *ServerConfig {
 	h := genBooksIndex(allBooks)
 	handlers = append(handlers, h...)
 
+	initPageCache()
+	debugCacheGet := func(uri string) func(w http.ResponseWriter, r *http.Request) {
+		if uri != "/_debug/cache" {
+			return nil
+		}
+		return serveDebugCache
+	}
+	debugCacheURLs := func() []string { return []string{"/_debug/cache"} }
+	handlers = append(handlers, NewDynamicHandler(debugCacheGet, debugCacheURLs))
+
 	serverWg.Add(1)
 	go func() {
 		waitBooksDone()
 		logf(ctx(), "buildServer: waitBooksDone() finished\n")
 		h := genSitemapHandler(booksToProcess)
 		handlers = append(handlers, h)
+		handlers = append(handlers, genSiteFeedHandler(booksToProcess))
 		serverWg.Done()
 	}()
 
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// bookProgress tracks the progress of a single book being downloaded/
+// generated concurrently.
+type bookProgress struct {
+	title string
+
+	mu     sync.Mutex
+	status string
+	done   bool
+	err    error
+}
+
+func (bp *bookProgress) setStatus(s string) {
+	bp.mu.Lock()
+	bp.status = s
+	bp.done = false
+	bp.err = nil
+	bp.mu.Unlock()
+}
+
+func (bp *bookProgress) setDone(err error) {
+	bp.mu.Lock()
+	bp.done = true
+	bp.err = err
+	bp.mu.Unlock()
+}
+
+func (bp *bookProgress) line() string {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.done {
+		if bp.err != nil {
+			return fmt.Sprintf("  %-24s FAILED: %s", bp.title, bp.err)
+		}
+		return fmt.Sprintf("  %-24s done", bp.title)
+	}
+	return fmt.Sprintf("  %-24s %s", bp.title, bp.status)
+}
+
+// multiBar renders one progress line per book (queued, in flight or done)
+// plus an aggregate line, to stderr. It's a no-op when disabled (stdout is not a TTY, or
+// -silent was passed), so redirecting output to a file or CI log doesn't
+// fill up with cursor-control noise.
+type multiBar struct {
+	enabled bool
+
+	mu          sync.Mutex
+	books       []*bookProgress
+	nLinesDrawn int
+}
+
+func newMultiBar(enabled bool, titles []string) *multiBar {
+	mb := &multiBar{enabled: enabled}
+	for _, t := range titles {
+		mb.books = append(mb.books, &bookProgress{title: t, status: "queued"})
+	}
+	return mb
+}
+
+// stdoutIsTerminal reports whether stdout looks like an interactive
+// terminal (as opposed to a file or pipe, e.g. in CI).
+func stdoutIsTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return (fi.Mode() & os.ModeCharDevice) != 0
+}
+
+func (mb *multiBar) bookAt(i int) *bookProgress {
+	return mb.books[i]
+}
+
+// redraw repaints all progress lines in place using ANSI cursor-up
+// sequences. Safe to call from multiple goroutines. nFilesWritten/
+// nBytesWritten only move once generation reaches WriteServerFilesToDir/
+// WriteServerFilesToDirCAS, so they stay at 0 during the download stage.
+func (mb *multiBar) redraw(nDownloaded, nFromCache, nFilesWritten int, nBytesWritten int64) {
+	if !mb.enabled {
+		return
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.nLinesDrawn > 0 {
+		fmt.Fprintf(os.Stderr, "\033[%dA", mb.nLinesDrawn)
+	}
+	var sb strings.Builder
+	for _, bp := range mb.books {
+		sb.WriteString("\033[K")
+		sb.WriteString(bp.line())
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\033[K")
+	fmt.Fprintf(&sb, "  total: %d downloaded, %d from cache, %d files written (%s)\n",
+		nDownloaded, nFromCache, nFilesWritten, formatSize(nBytesWritten))
+	fmt.Fprint(os.Stderr, sb.String())
+	mb.nLinesDrawn = len(mb.books) + 1
+}
+
+// finish leaves the final state of each line on screen.
+func (mb *multiBar) finish(nDownloaded, nFromCache, nFilesWritten int, nBytesWritten int64) {
+	mb.redraw(nDownloaded, nFromCache, nFilesWritten, nBytesWritten)
+}
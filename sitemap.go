@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sitemapEntry is one <url> entry queued for a book's sitemap.
+type sitemapEntry struct {
+	URI        string
+	LastMod    time.Time // zero value means "unknown", omitted from the XML
+	ChangeFreq string
+	Priority   float64
+}
+
+// addSitemapURL queues uri (made absolute if it isn't already) for book's
+// sitemap, along with the sitemaps.org fields. Call addSitemapPageURL
+// instead when you have a *Page, so lastmod/changefreq/priority don't need
+// to be guessed by the caller.
+func addSitemapURL(b *Book, uri string, lastmod time.Time, changefreq string, priority float64) {
+	if !isFullURL(uri) {
+		uri = urlJoin(siteBaseURL, uri)
+	}
+	b.muSitemapURLS.Lock()
+	b.sitemapURLS[uri] = sitemapEntry{
+		URI:        uri,
+		LastMod:    lastmod,
+		ChangeFreq: changefreq,
+		Priority:   priority,
+	}
+	b.muSitemapURLS.Unlock()
+}
+
+// notionTimeToGoTime converts a Notion LastEditedTime (Unix milliseconds)
+// into a time.Time. A zero input yields the zero time, so callers can tell
+// "unknown" apart from the epoch.
+func notionTimeToGoTime(unixMillis int64) time.Time {
+	if unixMillis == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unixMillis*int64(time.Millisecond)).UTC()
+}
+
+// pageLastEditedTime returns page's Notion LastEditedTime as a time.Time,
+// or the zero time if it's not available.
+func pageLastEditedTime(page *Page) time.Time {
+	if page == nil || page.NotionPage == nil {
+		return time.Time{}
+	}
+	root := page.NotionPage.Root()
+	if root == nil {
+		return time.Time{}
+	}
+	return notionTimeToGoTime(root.LastEditedTime)
+}
+
+// addSitemapPageURL queues page for book's sitemap. Chapter (top-level)
+// pages are weighted higher and assumed to change more often than deep
+// articles, matching how the book's nav treats them.
+func addSitemapPageURL(b *Book, page *Page, isChapter bool) {
+	changefreq := "monthly"
+	priority := 0.5
+	if isChapter {
+		changefreq = "weekly"
+		priority = 0.8
+	}
+	addSitemapURL(b, page.CanonnicalURL(), pageLastEditedTime(page), changefreq, priority)
+}
+
+// addSitemapBookPageURL is addSitemapPageURL for a BookPage (e.g. a
+// MarkdownPage), for books whose chapters aren't all Notion-backed *Page
+// values.
+func addSitemapBookPageURL(b *Book, page BookPage, isChapter bool) {
+	changefreq := "monthly"
+	priority := 0.5
+	if isChapter {
+		changefreq = "weekly"
+		priority = 0.8
+	}
+	addSitemapURL(b, urlJoin(siteBaseURL, page.URL()), page.LastEdited(), changefreq, priority)
+}
+
+// xmlURLSet / xmlURL mirror the sitemaps.org protocol:
+// https://www.sitemaps.org/protocol.html
+type xmlURLSet struct {
+	XMLName xml.Name `xml:"urlset"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	URLs    []xmlURL `xml:"url"`
+}
+
+type xmlURL struct {
+	Loc        string  `xml:"loc"`
+	LastMod    string  `xml:"lastmod,omitempty"`
+	ChangeFreq string  `xml:"changefreq,omitempty"`
+	Priority   float64 `xml:"priority,omitempty"`
+}
+
+type xmlSitemapIndex struct {
+	XMLName  xml.Name       `xml:"sitemapindex"`
+	Xmlns    string         `xml:"xmlns,attr"`
+	Sitemaps []xmlSitemapRef `xml:"sitemap"`
+}
+
+type xmlSitemapRef struct {
+	Loc string `xml:"loc"`
+}
+
+const sitemapXMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+// sitemaps.org limits: at most 50,000 URLs or 50MB (uncompressed) per file.
+const (
+	maxURLsPerSitemap  = 50000
+	maxBytesPerSitemap = 50 * 1000 * 1000
+)
+
+func entryToXMLURL(e sitemapEntry) xmlURL {
+	u := xmlURL{
+		Loc:        e.URI,
+		ChangeFreq: e.ChangeFreq,
+		Priority:   e.Priority,
+	}
+	if !e.LastMod.IsZero() {
+		u.LastMod = e.LastMod.Format("2006-01-02")
+	}
+	return u
+}
+
+// renderSitemapXMLFiles partitions entries into one or more sitemap-N.xml
+// payloads, respecting the sitemaps.org 50k-URL / 50MB-per-file limits, and
+// returns their bytes in order.
+func renderSitemapXMLFiles(entries []sitemapEntry) [][]byte {
+	var files [][]byte
+	var cur xmlURLSet
+	cur.Xmlns = sitemapXMLNS
+	curSize := 0
+
+	flush := func() {
+		if len(cur.URLs) == 0 {
+			return
+		}
+		d, err := xml.MarshalIndent(cur, "", "  ")
+		must(err)
+		out := append([]byte(xml.Header), d...)
+		files = append(files, out)
+		cur = xmlURLSet{Xmlns: sitemapXMLNS}
+		curSize = 0
+	}
+
+	for _, e := range entries {
+		u := entryToXMLURL(e)
+		// rough per-entry size estimate; good enough to stay well under
+		// the 50MB cap without marshaling on every iteration
+		entrySize := len(u.Loc) + len(u.LastMod) + len(u.ChangeFreq) + 64
+		if len(cur.URLs) >= maxURLsPerSitemap || curSize+entrySize > maxBytesPerSitemap {
+			flush()
+		}
+		cur.URLs = append(cur.URLs, u)
+		curSize += entrySize
+	}
+	flush()
+	return files
+}
+
+func renderSitemapIndexXML(sitemapURLs []string) []byte {
+	idx := xmlSitemapIndex{Xmlns: sitemapXMLNS}
+	for _, u := range sitemapURLs {
+		idx.Sitemaps = append(idx.Sitemaps, xmlSitemapRef{Loc: u})
+	}
+	d, err := xml.MarshalIndent(idx, "", "  ")
+	must(err)
+	return append([]byte(xml.Header), d...)
+}
+
+const robotsTmpl = `User-agent: *
+Disallow:
+
+Sitemap: %s
+`
+
+// genSitemapHandler builds /robots.txt and the XML sitemap for books:
+// either a single sitemap.xml, or (once the combined URL count/size crosses
+// the sitemaps.org limits) a sitemap_index.xml pointing at partitioned
+// sitemap-N.xml files. robots.txt always points at whichever one is the
+// entry point.
+func genSitemapHandler(books []*Book) Handler {
+	// http://www.advancedhtml.co.uk/robots-sitemaps.htm
+
+	var entries []sitemapEntry
+	entries = append(entries, sitemapEntry{
+		URI:        urlJoin(siteBaseURL, "feed.atom"),
+		ChangeFreq: "daily",
+		Priority:   0.3,
+	})
+	for _, b := range books {
+		addSitemapURL(b, "/", time.Time{}, "daily", 1.0)
+		for _, e := range b.sitemapURLS {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].URI < entries[j].URI })
+
+	files := renderSitemapXMLFiles(entries)
+	if len(files) == 0 {
+		empty := xmlURLSet{Xmlns: sitemapXMLNS}
+		d, err := xml.MarshalIndent(empty, "", "  ")
+		must(err)
+		files = [][]byte{append([]byte(xml.Header), d...)}
+	}
+
+	var entryPoint string
+	extra := map[string][]byte{}
+	if len(files) == 1 {
+		entryPoint = urlJoin(siteBaseURL, "sitemap.xml")
+		extra["/sitemap.xml"] = files[0]
+	} else {
+		var sitemapURLs []string
+		for i, f := range files {
+			name := fmt.Sprintf("/sitemap-%d.xml", i+1)
+			extra[name] = f
+			sitemapURLs = append(sitemapURLs, urlJoin(siteBaseURL, strings.TrimPrefix(name, "/")))
+		}
+		entryPoint = urlJoin(siteBaseURL, "sitemap_index.xml")
+		extra["/sitemap_index.xml"] = renderSitemapIndexXML(sitemapURLs)
+	}
+
+	robotsTxt := fmt.Sprintf(robotsTmpl, entryPoint)
+	h := NewContentHandler("/robots.txt", []byte(robotsTxt))
+	for uri, data := range extra {
+		h.Add(uri, data)
+	}
+	return h
+}
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
-	"compress/flate"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +12,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -75,43 +74,12 @@ func httpPost(uri string, body []byte) ([]byte, error) {
 	return ioutil.ReadAll(resp.Body)
 }
 
+// WriteServerFilesToZip keeps the original zip-only signature used by
+// existing callers; it's a thin wrapper around the format-agnostic
+// WriteServerFilesToArchive in archive.go.
 func WriteServerFilesToZip(handlers []server.Handler) ([]byte, error) {
-	nFiles := 0
-
 	var buf bytes.Buffer
-	zw := zip.NewWriter(&buf)
-	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
-		return flate.NewWriter(out, flate.BestCompression)
-	})
-
-	zipWriteFile := func(zw *zip.Writer, name string, data []byte) error {
-		fw, err := zw.Create(name)
-		if err != nil {
-			return err
-		}
-		_, err = fw.Write(data)
-		return err
-	}
-
-	var err error
-	writeFile := func(uri string, d []byte) {
-		if err != nil {
-			return
-		}
-		name := strings.TrimPrefix(uri, "/")
-		err = zipWriteFile(zw, name, d)
-		if err != nil {
-			return
-		}
-		sizeStr := formatSize(int64(len(d)))
-		if nFiles%128 == 0 {
-			logf(ctx(), "WriteServerFilesToZip: %d file '%s' of size %s\n", nFiles+1, name, sizeStr)
-		}
-		nFiles++
-	}
-	server.IterContent(handlers, writeFile)
-
-	if err != nil {
+	if err := WriteServerFilesToArchive(&buf, ArchiveFormatZip, handlers, ArchiveOptions{}); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
@@ -143,6 +111,8 @@ func WriteServerFilesToDir(dir string, handlers []server.Handler) (int, int64) {
 			logf(ctx(), "WriteServerFilesToDir: file %d '%s' of size %s\n", nFiles+1, path, sizeStr)
 		}
 		nFiles++
+		atomic.AddInt64(&nTotalFilesWritten, 1)
+		atomic.AddInt64(&nTotalBytesWritten, fsize)
 	}
 	server.IterContent(handlers, writeFile)
 	return nFiles, totalSize
@@ -178,6 +148,13 @@ func MakeHTTPServer(srv *server.Server) *http.Server {
 			return
 		}
 		if serve != nil {
+			if isPreview() {
+				rw := newReloadScriptInjectingWriter(w)
+				serve(rw, r)
+				rw.flush()
+				logHTTPReq(r, rw.statusCode, len(rw.buf), time.Since(timeStart))
+				return
+			}
 			cw := server.CapturingResponseWriter{ResponseWriter: w}
 			serve(&cw, r)
 			logHTTPReq(r, cw.StatusCode, cw.Size, time.Since(timeStart))
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// bookJobResult is the outcome of processing a single book in a worker
+// pool stage (see runBooksPoolStage).
+type bookJobResult struct {
+	book *Book
+	err  error
+}
+
+// runBooksPoolStage runs stage(book) for each book using nWorkers concurrent
+// goroutines against a shared multiBar, so callers can run several stages
+// (e.g. download, then generate) back to back while reusing one progress
+// display. It cancels outstanding work on SIGINT/SIGTERM, draining cleanly
+// like StartHTTPServer does, and returns one error per book instead of
+// panicking mid-run so a single bad book doesn't abort the whole batch.
+func runBooksPoolStage(books []*Book, nWorkers int, mb *multiBar, statusVerb string, stage func(*Book) error) []bookJobResult {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+
+	var cancelled int32
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigCh:
+			logf("runBooksPoolStage: got interrupt, draining in-flight books...\n")
+			atomic.StoreInt32(&cancelled, 1)
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		signal.Stop(sigCh)
+	}()
+
+	jobs := make(chan int, len(books))
+	for i := range books {
+		jobs <- i
+	}
+	close(jobs)
+
+	results := make([]bookJobResult, len(books))
+	var wg sync.WaitGroup
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				bp := mb.bookAt(i)
+				if atomic.LoadInt32(&cancelled) != 0 {
+					results[i] = bookJobResult{book: books[i], err: fmt.Errorf("cancelled")}
+					bp.setDone(results[i].err)
+					continue
+				}
+				bp.setStatus(statusVerb)
+				err := runStageSafely(stage, books[i])
+				results[i] = bookJobResult{book: books[i], err: err}
+				bp.setDone(err)
+			}
+		}()
+	}
+
+	// periodically repaint the progress bars while workers are running
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			mb.redraw(int(atomic.LoadInt32(&nTotalDownloaded)), int(atomic.LoadInt32(&nTotalFromCache)),
+				int(atomic.LoadInt64(&nTotalFilesWritten)), atomic.LoadInt64(&nTotalBytesWritten))
+			if allBooksDone(results, books) {
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	wg.Wait()
+	mb.finish(int(atomic.LoadInt32(&nTotalDownloaded)), int(atomic.LoadInt32(&nTotalFromCache)),
+		int(atomic.LoadInt64(&nTotalFilesWritten)), atomic.LoadInt64(&nTotalBytesWritten))
+	return results
+}
+
+func allBooksDone(results []bookJobResult, books []*Book) bool {
+	for i := range books {
+		if results[i].book == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func runStageSafely(stage func(*Book) error, book *Book) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return stage(book)
+}
+
+// newBooksMultiBar builds the shared progress display used by the parallel
+// download/generate stages below, so workers can be re-run between stages
+// (e.g. with buildFrontend in between) while reusing the same bars.
+func newBooksMultiBar(books []*Book, silent bool) *multiBar {
+	titles := make([]string, len(books))
+	for i, b := range books {
+		titles[i] = b.Title
+	}
+	return newMultiBar(!silent && stdoutIsTerminal(), titles)
+}
+
+// downloadBooksParallel runs initBook+downloadBook for each book using
+// nWorkers concurrent workers.
+func downloadBooksParallel(books []*Book, nWorkers int, mb *multiBar) []bookJobResult {
+	return runBooksPoolStage(books, nWorkers, mb, "downloading", func(book *Book) error {
+		initBook(book)
+		downloadBook(book)
+		return nil
+	})
+}
+
+// genBooksParallel runs genBook for each book using nWorkers concurrent
+// workers.
+func genBooksParallel(books []*Book, nWorkers int, mb *multiBar) []bookJobResult {
+	return runBooksPoolStage(books, nWorkers, mb, "generating", func(book *Book) error {
+		genBook(book)
+		return nil
+	})
+}
+
+// reportBookErrors prints an aggregated final report of per-book failures
+// and returns true if any book failed.
+func reportBookErrors(results []bookJobResult) bool {
+	hadErr := false
+	for _, r := range results {
+		if r.err != nil {
+			hadErr = true
+			fmt.Fprintf(os.Stderr, "book '%s' failed: %s\n", r.book.Title, r.err)
+		}
+	}
+	return hadErr
+}